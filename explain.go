@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/controllers"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/yaml"
+)
+
+func newExplainCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:          "explain <elastic-logs.yaml>",
+		Short:        "Print the search request of every tuple of an ElasticLogs, in the format of Kibana Dev Tools, or the LogQL query requests of loki tuples",
+		Args:         cobra.ExactArgs(1),
+		RunE:         runExplain,
+		SilenceUsage: true,
+	}
+}
+
+func runExplain(cmd *cobra.Command, args []string) error {
+	queryInterval, _ := cmd.Flags().GetDuration("query-interval")
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", args[0])
+	}
+	metric := elasticv1.ElasticLogs{}
+	if err := yaml.Unmarshal(data, &metric); err != nil {
+		return errors.Wrapf(err, "failed to decode %s", args[0])
+	}
+
+	exporter := &controllers.ElasticLogsReconciler{
+		Log:      ctrl.Log.WithName("explain"),
+		Interval: queryInterval,
+	}
+	for _, tuple := range metric.Spec.Tuples {
+		body, err := exporter.Explain(metric.Spec, tuple)
+		if err != nil {
+			return errors.Wrapf(err, "failed to explain tuple %s", tuple.MetricName)
+		}
+		// the requests of loki tuples include their endpoint
+		if metric.Spec.Type == query.BackendLoki {
+			fmt.Printf("# %s\n%s\n\n", tuple.MetricName, body)
+			continue
+		}
+		fmt.Printf("# %s\nGET %s/_search\n%s\n\n", tuple.MetricName, metric.Spec.Index, body)
+	}
+	return nil
+}
@@ -6,11 +6,15 @@ require (
 	github.com/flanksource/commons v1.4.3
 	github.com/flanksource/kommons v0.1.9
 	github.com/flanksource/template-operator v0.1.10
-	github.com/go-co-op/gocron v0.6.0
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/go-co-op/gocron v1.13.0
 	github.com/go-logr/logr v0.3.0
 	github.com/olivere/elastic/v7 v7.0.22
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.9.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.15.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/spf13/cobra v1.1.3
 	github.com/sykesm/zap-logfmt v0.0.4
 	go.uber.org/zap v1.15.0
@@ -19,6 +23,7 @@ require (
 	k8s.io/apimachinery v0.20.2
 	k8s.io/client-go v12.0.0+incompatible
 	sigs.k8s.io/controller-runtime v0.8.2
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace (
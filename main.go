@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
+	"net/http"
 	"os"
 	"time"
 
-	"github.com/flanksource/commons/logger"
-	"github.com/flanksource/kommons"
 	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
 	"github.com/flanksource/logs-exporter/pkg/controllers"
 	"github.com/flanksource/logs-exporter/pkg/metrics"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/flanksource/logs-exporter/pkg/scheduler"
+	"github.com/flanksource/logs-exporter/pkg/standalone"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	zaplogfmt "github.com/sykesm/zap-logfmt"
 	uzap "go.uber.org/zap"
@@ -18,6 +23,7 @@ import (
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
 var (
@@ -50,6 +56,21 @@ func runController(cmd *cobra.Command, args []string) {
 	syncPeriod, _ := cmd.Flags().GetDuration("sync-period")
 	enableLeaderElection, _ := cmd.Flags().GetBool("enable-leader-election")
 	queryInterval, _ := cmd.Flags().GetDuration("query-interval")
+	configPath, _ := cmd.Flags().GetString("config")
+	logQueries, _ := cmd.Flags().GetBool("log-queries")
+	enableWebhooks, _ := cmd.Flags().GetBool("enable-webhooks")
+	maxConcurrentReconciles, _ := cmd.Flags().GetInt("max-concurrent-reconciles")
+	limiter := newLimiter(cmd)
+
+	if queryInterval <= 0 {
+		setupLog.Error(errors.Errorf("query interval %s is not positive", queryInterval), "invalid flags")
+		os.Exit(1)
+	}
+
+	if configPath != "" {
+		runStandalone(configPath, metricsAddr, queryInterval, logQueries, limiter)
+		return
+	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
@@ -64,19 +85,17 @@ func runController(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	client := kommons.NewClient(mgr.GetConfig(), logger.StandardLogger())
-	clientset, err := client.GetClientset()
-	if err != nil {
-		setupLog.Error(err, "failed to get clientset")
-		os.Exit(1)
-	}
-
 	controller := &controllers.ElasticLogsReconciler{
 		Log:         ctrl.Log.WithName("controllers").WithName("Template"),
-		Clientset:   clientset,
 		Interval:    queryInterval,
 		MetricStore: metrics.NewMetricStore(),
+		Scheduler:   scheduler.NewScheduler(),
+		Clients:     query.NewClientPool(),
+		LogQueries:  logQueries,
 		Scheme:      mgr.GetScheme(),
+		Limiter:     limiter,
+
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	}
 
 	if err = controller.SetupWithManager(mgr); err != nil {
@@ -84,6 +103,10 @@ func runController(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	if enableWebhooks {
+		controllers.SetupWebhooksWithManager(mgr)
+	}
+
 	// // +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -93,6 +116,59 @@ func runController(cmd *cobra.Command, args []string) {
 	}
 }
 
+// runStandalone exports the ElasticLogs of the config file without kubernetes
+func runStandalone(configPath, metricsAddr string, queryInterval time.Duration, logQueries bool, limiter *query.Limiter) {
+	exporter := &controllers.ElasticLogsReconciler{
+		Log:         ctrl.Log.WithName("standalone"),
+		Interval:    queryInterval,
+		MetricStore: metrics.NewMetricStore(),
+		Scheduler:   scheduler.NewScheduler(),
+		Clients:     query.NewClientPool(),
+		LogQueries:  logQueries,
+		Limiter:     limiter,
+	}
+	runner := &standalone.Runner{
+		Path:     configPath,
+		Exporter: exporter,
+		Log:      ctrl.Log.WithName("standalone"),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(ctrlmetrics.Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: metricsAddr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			setupLog.Error(err, "problem serving metrics")
+			os.Exit(1)
+		}
+	}()
+
+	ctx := ctrl.SetupSignalHandler()
+	go func() {
+		if err := exporter.Scheduler.Start(ctx); err != nil {
+			setupLog.Error(err, "problem running scheduler")
+			os.Exit(1)
+		}
+	}()
+
+	setupLog.Info("starting standalone exporter", "config", configPath)
+	if err := runner.Start(ctx); err != nil {
+		setupLog.Error(err, "problem running standalone exporter")
+		os.Exit(1)
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		setupLog.Error(err, "problem stopping metrics server")
+	}
+}
+
+// newLimiter returns the limiter of the tuple queries configured by the
+// query-workers and max-queries-per-connection flags
+func newLimiter(cmd *cobra.Command) *query.Limiter {
+	workers, _ := cmd.Flags().GetInt("query-workers")
+	perConnection, _ := cmd.Flags().GetInt("max-queries-per-connection")
+	return query.NewLimiter(workers, perConnection)
+}
+
 func main() {
 	opts := zap.Options{Level: zapcore.DebugLevel}
 	// opts.BindFlags(flag.CommandLine)
@@ -110,7 +186,15 @@ func main() {
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	root.PersistentFlags().Duration("sync-period", 5*time.Minute, "Sync period")
-	root.PersistentFlags().Duration("query-interval", 5*time.Minute, "Query interval for counts gauge")
+	root.PersistentFlags().Duration("query-interval", 5*time.Minute, "Default interval between queries and time window they cover")
+	root.Flags().String("config", "", "Export the ElasticLogs of this YAML file instead of running the controller, reloading it when it changes")
+	root.Flags().Bool("enable-webhooks", false, "Serve the defaulting and validating webhooks of ElasticLogs on port 9443, with the certificate in /tmp/k8s-webhook-server/serving-certs")
+	root.PersistentFlags().Bool("log-queries", false, "Log the body of every search request")
+	root.PersistentFlags().Int("query-workers", 10, "Maximum number of tuple queries running at once, 0 for unlimited")
+	root.PersistentFlags().Int("max-queries-per-connection", 2, "Maximum number of tuple queries running at once against the same cluster, 0 for unlimited")
+	root.Flags().Int("max-concurrent-reconciles", 1, "Maximum number of ElasticLogs and ElasticsearchConnections reconciled at once")
+	root.AddCommand(newQueryCommand())
+	root.AddCommand(newExplainCommand())
 
 	if err := root.Execute(); err != nil {
 		os.Exit(1)
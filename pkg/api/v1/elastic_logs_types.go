@@ -6,15 +6,95 @@ import (
 
 // ElasticLogsSpec defines the desired state of ElasticLogs
 type ElasticLogsSpec struct {
-	Index    string    `json:"index,omitempty"`
-	URL      string    `json:"url,omitempty"`
-	Username string    `json:"username,omitempty"`
-	Password SecretRef `json:"password,omitempty"`
-	Tuples   []Tuple   `json:"tuples,omitempty"`
+	// Type of the cluster, elasticsearch, opensearch or loki. Defaults to
+	// elasticsearch.
+	// +kubebuilder:validation:Enum=elasticsearch;opensearch;loki
+	Type string `json:"type,omitempty"`
+	// Index pattern queried, or the LogQL stream selector of loki, which
+	// defaults to the streams having every filter and aggregate label
+	Index string `json:"index,omitempty"`
+	// Connection references an ElasticsearchConnection whose type, url,
+	// credentials, TLS options and timeouts are used instead of the ones of
+	// the spec
+	Connection *ConnectionRef `json:"connection,omitempty"`
+	URL        string         `json:"url,omitempty"`
+	Username   string         `json:"username,omitempty"`
+	Password   SecretRef      `json:"password,omitempty"`
+	// Auth is used instead of Username and Password for API key, token or
+	// client certificate authentication
+	Auth *Auth `json:"auth,omitempty"`
+	TLS  *TLS  `json:"tls,omitempty"`
+	// Interval between queries of every tuple, defaults to --query-interval
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Schedule is a cron expression for querying every tuple, takes
+	// precedence over Interval
+	Schedule string `json:"schedule,omitempty"`
+	// TimeField is the date field the query window applies to, defaults to
+	// @timestamp
+	TimeField string `json:"timeField,omitempty"`
+	// Window of documents queried, defaults to --query-interval
+	Window *metav1.Duration `json:"window,omitempty"`
+	// Offset moves the end of the window back from the query time to
+	// tolerate ingestion lag
+	Offset *metav1.Duration `json:"offset,omitempty"`
+	// Timeout bounds every query of a tuple, including waiting for a query
+	// slot, defaults to the interval of the tuple
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// StaticLabels are added to the series of every tuple, their values are
+	// templates executed on the metadata of the ElasticLogs, e.g.
+	// {{ .Name }} or {{ index .Labels "team" }}
+	StaticLabels map[string]string `json:"staticLabels,omitempty"`
+	Tuples       []Tuple           `json:"tuples,omitempty"`
 }
 
 type SecretRef struct {
-	Name      string `json:"name,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Namespace of the secret, defaults to the namespace of a
+	// NamespacedElasticLogs, which cannot reference other namespaces
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key,omitempty"`
+}
+
+// Auth references the secrets holding the credentials of the client, only one
+// of APIKey, Token or ClientCert and ClientKey should be set
+type Auth struct {
+	// APIKey is the base64 encoded id:api_key pair, sent as an ApiKey
+	// authorization header
+	APIKey *SecretRef `json:"apiKey,omitempty"`
+	// Token is a bearer or service account token
+	Token *SecretRef `json:"token,omitempty"`
+	// ClientCert and ClientKey are the PEM encoded certificate and key used
+	// for TLS client authentication, their keys default to tls.crt and
+	// tls.key
+	ClientCert *SecretRef `json:"clientCert,omitempty"`
+	ClientKey  *SecretRef `json:"clientKey,omitempty"`
+}
+
+// TLS configures the verification of the elasticsearch certificate, which is
+// verified against the system certificate authorities by default
+type TLS struct {
+	// CASecret or CAConfigMap reference a PEM encoded bundle of certificate
+	// authorities trusted instead of the system ones, their keys default to
+	// ca.crt
+	CASecret    *SecretRef    `json:"caSecret,omitempty"`
+	CAConfigMap *ConfigMapRef `json:"caConfigMap,omitempty"`
+	// ServerName overrides the host name the certificate is verified against
+	ServerName string `json:"serverName,omitempty"`
+	// InsecureSkipVerify disables the verification of the certificate
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+type ConnectionRef struct {
+	Name string `json:"name"`
+	// Namespace of the connection, defaults to the namespace of a
+	// NamespacedElasticLogs, which cannot reference other namespaces
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type ConfigMapRef struct {
+	Name string `json:"name,omitempty"`
+	// Namespace of the config map, defaults to the namespace of a
+	// NamespacedElasticLogs, which cannot reference other namespaces
 	Namespace string `json:"namespace,omitempty"`
 	Key       string `json:"key,omitempty"`
 }
@@ -23,21 +103,113 @@ type Tuple struct {
 	MetricName string            `json:"metricName,omitempty"`
 	Filters    map[string]string `json:"filters,omitempty"`
 	Aggregate  Pair              `json:"aggregate,omitempty"`
+	// Interval, Schedule, TimeField, Window, Offset and Timeout override the
+	// ones set on the spec
+	Interval  *metav1.Duration `json:"interval,omitempty"`
+	Schedule  string           `json:"schedule,omitempty"`
+	TimeField string           `json:"timeField,omitempty"`
+	Window    *metav1.Duration `json:"window,omitempty"`
+	Offset    *metav1.Duration `json:"offset,omitempty"`
+	Timeout   *metav1.Duration `json:"timeout,omitempty"`
+	// Size is the maximum number of buckets of every terms aggregation, or
+	// the page size when Paginate is set. Defaults to 100. The documents
+	// left out of truncated aggregations are exported with other="true".
+	// +kubebuilder:validation:Minimum=1
+	Size int `json:"size,omitempty"`
+	// Paginate pages through every combination of filter and aggregate
+	// values with a composite aggregation instead of truncating them to Size
+	Paginate bool `json:"paginate,omitempty"`
+	// Query restricts the documents aggregated by the tuple, in addition to
+	// the window
+	Query *TupleQuery `json:"query,omitempty"`
+	// StaticLabels are added to the series of the tuple, overriding the ones
+	// of the spec
+	StaticLabels map[string]string `json:"staticLabels,omitempty"`
+}
+
+// TupleQuery selects documents matching QueryString and every clause of Must
+// but none of MustNot
+type TupleQuery struct {
+	// QueryString is a Lucene query string, e.g.
+	// status:[500 TO 599] AND NOT url.path:"/healthz"
+	QueryString string   `json:"queryString,omitempty"`
+	Must        []Clause `json:"must,omitempty"`
+	MustNot     []Clause `json:"mustNot,omitempty"`
+}
+
+// Clause matches documents on Field, only one of Term, Wildcard, Exists or
+// Range should be set
+type Clause struct {
+	Field string `json:"field"`
+	// Term matches the exact value of Field
+	Term string `json:"term,omitempty"`
+	// Wildcard matches Field against a pattern, where * matches any
+	// characters and ? a single one
+	Wildcard string `json:"wildcard,omitempty"`
+	// Exists matches documents having a value for Field
+	Exists bool   `json:"exists,omitempty"`
+	Range  *Range `json:"range,omitempty"`
+}
+
+// Range bounds numeric or date values of a field, dates may use date math
+// such as now-1h
+type Range struct {
+	Gt  string `json:"gt,omitempty"`
+	Gte string `json:"gte,omitempty"`
+	Lt  string `json:"lt,omitempty"`
+	Lte string `json:"lte,omitempty"`
 }
 
 type Pair struct {
 	Name  string `json:"name,omitempty"`
 	Field string `json:"field,omitempty"`
+	// Type of the value exported for every bucket of Field, one of count,
+	// sum, avg, min, max, percentiles or cardinality. Defaults to count.
+	// +kubebuilder:validation:Enum=count;sum;avg;min;max;percentiles;cardinality
+	Type string `json:"type,omitempty"`
+	// ValueField is the numeric field the value is computed on, required
+	// unless Type is count
+	ValueField string `json:"valueField,omitempty"`
+	// Percents computed when Type is percentiles, e.g. "50", "95", "99.9".
+	// Every percentile is exported with a quantile label.
+	Percents []string `json:"percents,omitempty"`
 }
 
+// Condition types reported in ElasticLogsStatus
+const (
+	ConditionReady               = "Ready"
+	ConditionCredentialsResolved = "CredentialsResolved"
+	ConditionElasticReachable    = "ElasticReachable"
+	ConditionQueryFailed         = "QueryFailed"
+)
+
 // ElasticLogsStatus defines the observed state of Template
 type ElasticLogsStatus struct {
+	ObservedGeneration      int64              `json:"observedGeneration,omitempty"`
+	LastSuccessfulQueryTime *metav1.Time       `json:"lastSuccessfulQueryTime,omitempty"`
+	Conditions              []metav1.Condition `json:"conditions,omitempty"`
+	Tuples                  []TupleStatus      `json:"tuples,omitempty"`
+}
+
+// TupleStatus summarises the last query of a tuple
+type TupleStatus struct {
+	MetricName  string           `json:"metricName"`
+	Series      int              `json:"series"`
+	Duration    *metav1.Duration `json:"duration,omitempty"`
+	LastRunTime *metav1.Time     `json:"lastRunTime,omitempty"`
+	LastError   string           `json:"lastError,omitempty"`
+	Warning     string           `json:"warning,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:resource:scope="Cluster"
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].reason"
+// +kubebuilder:printcolumn:name="Last Query",type="date",JSONPath=".status.lastSuccessfulQueryTime"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // ElasticLogs is the Schema for the ElasticLogss API
 type ElasticLogs struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -56,6 +228,32 @@ type ElasticLogsList struct {
 	Items           []ElasticLogs `json:"items"`
 }
 
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].reason"
+// +kubebuilder:printcolumn:name="Last Query",type="date",JSONPath=".status.lastSuccessfulQueryTime"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// NamespacedElasticLogs is an ElasticLogs that can only reference secrets and
+// config maps of its own namespace, which is added as an exported_namespace
+// label to the series it exports
+type NamespacedElasticLogs struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ElasticLogsSpec   `json:"spec,omitempty"`
+	Status ElasticLogsStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NamespacedElasticLogsList contains a list of NamespacedElasticLogs
+type NamespacedElasticLogsList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespacedElasticLogs `json:"items"`
+}
+
 func init() {
-	SchemeBuilder.Register(&ElasticLogs{}, &ElasticLogsList{})
+	SchemeBuilder.Register(&ElasticLogs{}, &ElasticLogsList{}, &NamespacedElasticLogs{}, &NamespacedElasticLogsList{})
 }
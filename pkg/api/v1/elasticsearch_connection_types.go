@@ -0,0 +1,63 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ElasticsearchConnectionSpec defines the endpoint, credentials and TLS
+// options shared by the ElasticLogs referencing the connection. Its secret and
+// config map references default to, and cannot leave, its namespace.
+type ElasticsearchConnectionSpec struct {
+	// Type of the cluster, elasticsearch, opensearch or loki. Defaults to
+	// elasticsearch.
+	// +kubebuilder:validation:Enum=elasticsearch;opensearch;loki
+	Type     string    `json:"type,omitempty"`
+	URL      string    `json:"url"`
+	Username string    `json:"username,omitempty"`
+	Password SecretRef `json:"password,omitempty"`
+	// Auth is used instead of Username and Password for API key, token or
+	// client certificate authentication
+	Auth *Auth `json:"auth,omitempty"`
+	TLS  *TLS  `json:"tls,omitempty"`
+	// ConnectTimeout bounds establishing a connection and its TLS handshake,
+	// defaults to 10s
+	ConnectTimeout *metav1.Duration `json:"connectTimeout,omitempty"`
+	// RequestTimeout bounds every request, including reading the response
+	RequestTimeout *metav1.Duration `json:"requestTimeout,omitempty"`
+}
+
+// ElasticsearchConnectionStatus reports the last probe of the connection
+type ElasticsearchConnectionStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	LastProbeTime      *metav1.Time       `json:"lastProbeTime,omitempty"`
+	Version            string             `json:"version,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="URL",type="string",JSONPath=".spec.url"
+// +kubebuilder:printcolumn:name="Reachable",type="string",JSONPath=".status.conditions[?(@.type==\"ElasticReachable\")].status"
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".status.version"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// ElasticsearchConnection is a cluster endpoint shared by many ElasticLogs
+type ElasticsearchConnection struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ElasticsearchConnectionSpec   `json:"spec,omitempty"`
+	Status ElasticsearchConnectionStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ElasticsearchConnectionList contains a list of ElasticsearchConnection
+type ElasticsearchConnectionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ElasticsearchConnection `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ElasticsearchConnection{}, &ElasticsearchConnectionList{})
+}
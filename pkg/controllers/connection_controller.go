@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// connectionIndex indexes ElasticLogs by the namespace/name of the connection
+// they reference
+const connectionIndex = "spec.connection"
+
+// connectionProbeInterval is the interval between probes of the reachability
+// and version of every connection
+const connectionProbeInterval = time.Minute
+
+// connectionProbeTimeout bounds a probe of a connection without a request
+// timeout
+const connectionProbeTimeout = 10 * time.Second
+
+// connectionRefs returns the namespace/name of the connection referenced by
+// the ElasticLogs or NamespacedElasticLogs, for the connection index
+func connectionRefs(object client.Object) []string {
+	switch object.(type) {
+	case *elasticv1.ElasticLogs, *elasticv1.NamespacedElasticLogs:
+	default:
+		return nil
+	}
+	spec, _ := restrictNamespace(object.GetNamespace(), asElasticLogs(object).Spec)
+	if spec.Connection == nil {
+		return nil
+	}
+	return []string{types.NamespacedName{Namespace: spec.Connection.Namespace, Name: spec.Connection.Name}.String()}
+}
+
+// connectionRequests maps a connection to the ElasticLogs and
+// NamespacedElasticLogs referencing it
+func (r *ElasticLogsReconciler) connectionRequests(object client.Object) []reconcile.Request {
+	return r.dependentRequests(types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()})
+}
+
+func (r *ElasticLogsReconciler) dependentRequests(connection types.NamespacedName) []reconcile.Request {
+	key := connection.String()
+	list := elasticv1.ElasticLogsList{}
+	if err := r.ControllerClient.List(context.Background(), &list, client.MatchingFields{connectionIndex: key}); err != nil {
+		r.Log.Error(err, "failed to list elastic metrics referencing connection", "connection", key)
+		return nil
+	}
+	namespacedList := elasticv1.NamespacedElasticLogsList{}
+	if err := r.ControllerClient.List(context.Background(), &namespacedList, client.MatchingFields{connectionIndex: key}); err != nil {
+		r.Log.Error(err, "failed to list namespaced elastic metrics referencing connection", "connection", key)
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, metric := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: metric.Namespace, Name: metric.Name}})
+	}
+	for _, metric := range namespacedList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: metric.Namespace, Name: metric.Name}})
+	}
+	return requests
+}
+
+// connectionSpec returns the endpoint, credentials and TLS options of the
+// connection as an ElasticLogsSpec
+func connectionSpec(connection elasticv1.ElasticsearchConnection) elasticv1.ElasticLogsSpec {
+	spec := connection.Spec.DeepCopy()
+	return elasticv1.ElasticLogsSpec{
+		Type:     spec.Type,
+		URL:      spec.URL,
+		Username: spec.Username,
+		Password: spec.Password,
+		Auth:     spec.Auth,
+		TLS:      spec.TLS,
+	}
+}
+
+func connectionTimeouts(connection elasticv1.ElasticsearchConnection) query.Timeouts {
+	timeouts := query.Timeouts{}
+	if connection.Spec.ConnectTimeout != nil {
+		timeouts.Connect = connection.Spec.ConnectTimeout.Duration
+	}
+	if connection.Spec.RequestTimeout != nil {
+		timeouts.Request = connection.Spec.RequestTimeout.Duration
+	}
+	return timeouts
+}
+
+// resolveConnection returns the spec with the endpoint, credentials and TLS
+// options of the connection it references, restricted to the namespace of
+// the connection, and the timeouts of the connection
+func (r *ElasticLogsReconciler) resolveConnection(ctx context.Context, spec elasticv1.ElasticLogsSpec) (elasticv1.ElasticLogsSpec, query.Timeouts, error) {
+	if spec.Connection == nil {
+		return spec, query.Timeouts{}, nil
+	}
+	connection := elasticv1.ElasticsearchConnection{}
+	name := types.NamespacedName{Namespace: spec.Connection.Namespace, Name: spec.Connection.Name}
+	if err := r.ControllerClient.Get(ctx, name, &connection); err != nil {
+		return spec, query.Timeouts{}, errors.Wrapf(err, "failed to get connection %s", name)
+	}
+	endpoint, err := restrictNamespace(connection.Namespace, connectionSpec(connection))
+	if err != nil {
+		return spec, query.Timeouts{}, errors.Wrapf(err, "invalid connection %s", name)
+	}
+
+	spec.Type = endpoint.Type
+	spec.URL = endpoint.URL
+	spec.Username = endpoint.Username
+	spec.Password = endpoint.Password
+	spec.Auth = endpoint.Auth
+	spec.TLS = endpoint.TLS
+	return spec, connectionTimeouts(connection), nil
+}
+
+// connectionReason returns the reason of the CredentialsResolved condition
+// for an error returned by resolveConnection
+func connectionReason(err error) string {
+	if kerrors.IsNotFound(errors.Cause(err)) {
+		return "ConnectionNotFound"
+	}
+	return "ConnectionInvalid"
+}
+
+// connectionReconciler probes the ElasticsearchConnections, sharing the
+// clients of the ElasticLogsReconciler
+type connectionReconciler struct {
+	*ElasticLogsReconciler
+}
+
+func (r *connectionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("ElasticsearchConnection", req.NamespacedName)
+	owner := "ElasticsearchConnection/" + req.NamespacedName.String()
+
+	connection := elasticv1.ElasticsearchConnection{}
+	if err := r.ControllerClient.Get(ctx, req.NamespacedName, &connection); err != nil {
+		if kerrors.IsNotFound(err) {
+			r.Clients.Release(owner)
+			return reconcile.Result{}, nil
+		}
+		log.Error(err, "failed to get connection")
+		return reconcile.Result{}, err
+	}
+
+	spec, err := restrictNamespace(connection.Namespace, connectionSpec(connection))
+	if err != nil {
+		r.setConnectionCondition(ctx, req.NamespacedName, elasticv1.ConditionCredentialsResolved, metav1.ConditionFalse, "NamespaceForbidden", err.Error())
+		return reconcile.Result{}, nil
+	}
+	credentials, err := r.credentials(ctx, spec)
+	tlsOptions := query.TLS{}
+	if err == nil {
+		tlsOptions, err = r.tlsOptions(ctx, spec)
+	}
+	if err != nil {
+		log.Error(err, "failed to resolve credentials")
+		r.setConnectionCondition(ctx, req.NamespacedName, elasticv1.ConditionCredentialsResolved, metav1.ConditionFalse, secretReason(err), err.Error())
+		return reconcile.Result{}, err
+	}
+	return r.probe(ctx, req.NamespacedName, owner, spec, credentials, tlsOptions, connectionTimeouts(connection))
+}
+
+// probe requests the version of the cluster and reports it in the status of
+// the connection
+func (r *connectionReconciler) probe(ctx context.Context, name types.NamespacedName, owner string, spec elasticv1.ElasticLogsSpec, credentials query.Credentials, tlsOptions query.TLS, timeouts query.Timeouts) (ctrl.Result, error) {
+	backend, err := r.Clients.Get(owner, spec.Type, spec.URL, credentials, tlsOptions, timeouts)
+	if err != nil {
+		r.setConnectionCondition(ctx, name, elasticv1.ConditionElasticReachable, metav1.ConditionFalse, "ClientFailed", err.Error())
+		return reconcile.Result{}, err
+	}
+
+	timeout := connectionProbeTimeout
+	if timeouts.Request > 0 {
+		timeout = timeouts.Request
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	version, probeErr := backend.Version(probeCtx)
+
+	err = r.updateConnectionStatus(ctx, name, func(connection *elasticv1.ElasticsearchConnection) {
+		connection.Status.ObservedGeneration = connection.Generation
+		connection.Status.LastProbeTime = &metav1.Time{Time: time.Now()}
+		setConnectionCondition(connection, elasticv1.ConditionCredentialsResolved, metav1.ConditionTrue, "SecretResolved", "")
+		if probeErr != nil {
+			setConnectionCondition(connection, elasticv1.ConditionElasticReachable, metav1.ConditionFalse, "ProbeFailed", probeErr.Error())
+			return
+		}
+		connection.Status.Version = version
+		setConnectionCondition(connection, elasticv1.ConditionElasticReachable, metav1.ConditionTrue, "ProbeSucceeded", "")
+	})
+	if err != nil {
+		r.Log.Error(err, "failed to update status", "ElasticsearchConnection", name)
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{RequeueAfter: connectionProbeInterval}, nil
+}
+
+// updateConnectionStatus applies update to the latest version of the
+// connection and writes its status back
+func (r *connectionReconciler) updateConnectionStatus(ctx context.Context, name types.NamespacedName, update func(connection *elasticv1.ElasticsearchConnection)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		connection := elasticv1.ElasticsearchConnection{}
+		if err := r.ControllerClient.Get(ctx, name, &connection); err != nil {
+			return err
+		}
+		update(&connection)
+		return r.ControllerClient.Status().Update(ctx, &connection)
+	})
+}
+
+func (r *connectionReconciler) setConnectionCondition(ctx context.Context, name types.NamespacedName, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	err := r.updateConnectionStatus(ctx, name, func(connection *elasticv1.ElasticsearchConnection) {
+		setConnectionCondition(connection, conditionType, status, reason, message)
+	})
+	if err != nil {
+		r.Log.Error(err, "failed to update status", "ElasticsearchConnection", name)
+	}
+}
+
+func setConnectionCondition(connection *elasticv1.ElasticsearchConnection, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&connection.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: connection.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"context"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// secretIndex indexes ElasticLogs by the namespace/name of every secret they
+// reference
+const secretIndex = "spec.secretRefs"
+
+// secretRefs returns the namespace/name of every secret referenced by the
+// ElasticLogs, NamespacedElasticLogs or ElasticsearchConnection, for the
+// secret index
+func secretRefs(object client.Object) []string {
+	var spec elasticv1.ElasticLogsSpec
+	switch object.(type) {
+	case *elasticv1.ElasticLogs, *elasticv1.NamespacedElasticLogs:
+		spec = asElasticLogs(object).Spec
+	case *elasticv1.ElasticsearchConnection:
+		spec = connectionSpec(*object.(*elasticv1.ElasticsearchConnection))
+	default:
+		return nil
+	}
+	// references to other namespaces are indexed as well, they fail when
+	// reconciling
+	spec, _ = restrictNamespace(object.GetNamespace(), spec)
+	refs := []*elasticv1.SecretRef{&spec.Password}
+	if auth := spec.Auth; auth != nil {
+		refs = append(refs, auth.APIKey, auth.Token, auth.ClientCert, auth.ClientKey)
+	}
+	if spec.TLS != nil {
+		refs = append(refs, spec.TLS.CASecret)
+	}
+
+	keys := []string{}
+	for _, ref := range refs {
+		if ref != nil && ref.Name != "" {
+			keys = append(keys, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}.String())
+		}
+	}
+	return keys
+}
+
+// secretRequests maps a secret to the ElasticLogs and NamespacedElasticLogs
+// referencing it, directly or through their connection, so that rotated
+// credentials are picked up immediately
+func (r *ElasticLogsReconciler) secretRequests(object client.Object) []reconcile.Request {
+	key := types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()}.String()
+	list := elasticv1.ElasticLogsList{}
+	if err := r.ControllerClient.List(context.Background(), &list, client.MatchingFields{secretIndex: key}); err != nil {
+		r.Log.Error(err, "failed to list elastic metrics referencing secret", "secret", key)
+		return nil
+	}
+	namespacedList := elasticv1.NamespacedElasticLogsList{}
+	if err := r.ControllerClient.List(context.Background(), &namespacedList, client.MatchingFields{secretIndex: key}); err != nil {
+		r.Log.Error(err, "failed to list namespaced elastic metrics referencing secret", "secret", key)
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, metric := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: metric.Namespace, Name: metric.Name}})
+	}
+	for _, metric := range namespacedList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: metric.Namespace, Name: metric.Name}})
+	}
+	for _, connection := range r.secretConnectionRequests(object) {
+		requests = append(requests, r.dependentRequests(connection.NamespacedName)...)
+	}
+	return requests
+}
+
+// secretConnectionRequests maps a secret to the ElasticsearchConnections
+// referencing it
+func (r *ElasticLogsReconciler) secretConnectionRequests(object client.Object) []reconcile.Request {
+	key := types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()}.String()
+	list := elasticv1.ElasticsearchConnectionList{}
+	if err := r.ControllerClient.List(context.Background(), &list, client.MatchingFields{secretIndex: key}); err != nil {
+		r.Log.Error(err, "failed to list connections referencing secret", "secret", key)
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, connection := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: connection.Namespace, Name: connection.Name}})
+	}
+	return requests
+}
+
+// credentials resolves the secrets referenced by the spec, Username and
+// Password are only used when Auth is not set. Specs without a password
+// secret query the cluster without authentication, or with the username only.
+func (r *ElasticLogsReconciler) credentials(ctx context.Context, spec elasticv1.ElasticLogsSpec) (query.Credentials, error) {
+	credentials := query.Credentials{}
+	auth := spec.Auth
+	if auth == nil {
+		credentials.Username = spec.Username
+		if spec.Password.Name == "" {
+			return credentials, nil
+		}
+		password, err := r.secretValue(ctx, &spec.Password, DefaultPasswordKey)
+		if err != nil {
+			return credentials, err
+		}
+		credentials.Password = string(password)
+		return credentials, nil
+	}
+
+	var err error
+	var value []byte
+	switch {
+	case auth.APIKey != nil:
+		value, err = r.secretValue(ctx, auth.APIKey, "")
+		credentials.APIKey = string(value)
+	case auth.Token != nil:
+		value, err = r.secretValue(ctx, auth.Token, "")
+		credentials.Token = string(value)
+	}
+	if err != nil {
+		return credentials, err
+	}
+
+	if auth.ClientCert != nil || auth.ClientKey != nil {
+		if auth.ClientCert == nil || auth.ClientKey == nil {
+			return credentials, errors.New("clientCert and clientKey must be set together")
+		}
+		if credentials.ClientCert, err = r.secretValue(ctx, auth.ClientCert, "tls.crt"); err != nil {
+			return credentials, err
+		}
+		if credentials.ClientKey, err = r.secretValue(ctx, auth.ClientKey, "tls.key"); err != nil {
+			return credentials, err
+		}
+	}
+	return credentials, nil
+}
+
+// tlsOptions resolves the certificate authorities referenced by the spec
+func (r *ElasticLogsReconciler) tlsOptions(ctx context.Context, spec elasticv1.ElasticLogsSpec) (query.TLS, error) {
+	tlsOptions := query.TLS{}
+	if spec.TLS == nil {
+		return tlsOptions, nil
+	}
+	tlsOptions.ServerName = spec.TLS.ServerName
+	tlsOptions.InsecureSkipVerify = spec.TLS.InsecureSkipVerify
+
+	var err error
+	switch {
+	case spec.TLS.CASecret != nil:
+		tlsOptions.CA, err = r.secretValue(ctx, spec.TLS.CASecret, "ca.crt")
+	case spec.TLS.CAConfigMap != nil:
+		tlsOptions.CA, err = r.configMapValue(ctx, spec.TLS.CAConfigMap, "ca.crt")
+	}
+	return tlsOptions, err
+}
+
+// secretValue returns the value of the key of the referenced secret, using
+// defaultKey when the reference has no key
+func (r *ElasticLogsReconciler) secretValue(ctx context.Context, ref *elasticv1.SecretRef, defaultKey string) ([]byte, error) {
+	key := ref.Key
+	if key == "" {
+		key = defaultKey
+	}
+	// secrets are read from the cache of the manager, which watches them
+	secret := corev1.Secret{}
+	if err := r.ControllerClient.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, &secret); err != nil {
+		return nil, errors.Wrapf(err, "failed to get secret %s/%s", ref.Namespace, ref.Name)
+	}
+	value, found := secret.Data[key]
+	if !found {
+		return nil, errors.Errorf("failed to find field %s in secret %s/%s", key, secret.Namespace, secret.Name)
+	}
+	return value, nil
+}
+
+// configMapValue returns the value of the key of the referenced config map,
+// using defaultKey when the reference has no key
+func (r *ElasticLogsReconciler) configMapValue(ctx context.Context, ref *elasticv1.ConfigMapRef, defaultKey string) ([]byte, error) {
+	key := ref.Key
+	if key == "" {
+		key = defaultKey
+	}
+	configMap := corev1.ConfigMap{}
+	if err := r.ControllerClient.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, &configMap); err != nil {
+		return nil, errors.Wrapf(err, "failed to get config map %s/%s", ref.Namespace, ref.Name)
+	}
+	value, found := configMap.Data[key]
+	if !found {
+		return nil, errors.Errorf("failed to find field %s in config map %s/%s", key, configMap.Namespace, configMap.Name)
+	}
+	return []byte(value), nil
+}
+
+// secretReason returns the reason of the CredentialsResolved condition for
+// an error returned by credentials
+func secretReason(err error) string {
+	if kerrors.IsNotFound(errors.Cause(err)) {
+		return "SecretNotFound"
+	}
+	if _, ok := errors.Cause(err).(kerrors.APIStatus); ok {
+		return "SecretNotReadable"
+	}
+	return "SecretKeyNotFound"
+}
@@ -18,53 +18,73 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
 	"github.com/flanksource/logs-exporter/pkg/metrics"
 	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/flanksource/logs-exporter/pkg/scheduler"
 	"github.com/flanksource/template-operator/k8s"
 	"github.com/go-logr/logr"
-	elastic "github.com/olivere/elastic/v7"
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
-var (
-	documentsCount = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "elasticsearch_documents_count",
-			Help: "A gauge representing documents count by field",
-		},
-		[]string{"cluster", "type", "value"},
-	)
-)
+// Finalizer removes the series of an ElasticLogs before it is deleted
+const Finalizer = "metrics.flanksource.com/series"
 
-func init() {
-	prometheus.MustRegister(documentsCount)
-}
+// quantileLabel holds the quantile of percentiles tuples
+const quantileLabel = "quantile"
+
+// otherLabel is "true" on the series of the documents left out of truncated
+// terms aggregations, and empty, which Prometheus drops, on every other series
+const otherLabel = "other"
 
 // ElasticLogsReconciler reconciles a ElasticLogs object
 type ElasticLogsReconciler struct {
 	ControllerClient client.Client
-	Clientset        *kubernetes.Clientset
 	Log              logr.Logger
 	MetricStore      *metrics.MetricStore
+	Scheduler        *scheduler.Scheduler
+	Clients          *query.ClientPool
 	Interval         time.Duration
 	Scheme           *runtime.Scheme
 	Cache            *k8s.SchemaCache
+	// LogQueries logs the body of the search request of every tuple query
+	LogQueries bool
+	// Limiter bounds the tuple queries running at once, queries are
+	// unlimited without it
+	Limiter *query.Limiter
+	// MaxConcurrentReconciles is the number of ElasticLogs, and of
+	// ElasticsearchConnections, reconciled at once, defaults to 1
+	MaxConcurrentReconciles int
 }
 
 // +kubebuilder:rbac:groups="metrics.flanksource.com",resources="elasticlogs",verbs="*"
-// +kubebuilder:rbac:groups="",resources="secrets",verbs="get;list"
+// +kubebuilder:rbac:groups="metrics.flanksource.com",resources="elasticlogs/status",verbs=get;update;patch
+// +kubebuilder:rbac:groups="metrics.flanksource.com",resources="namespacedelasticlogs",verbs="*"
+// +kubebuilder:rbac:groups="metrics.flanksource.com",resources="namespacedelasticlogs/status",verbs=get;update;patch
+// +kubebuilder:rbac:groups="metrics.flanksource.com",resources="elasticsearchconnections",verbs=get;list;watch
+// +kubebuilder:rbac:groups="metrics.flanksource.com",resources="elasticsearchconnections/status",verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources="secrets",verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources="configmaps",verbs=get;list;watch
 
 func (r *ElasticLogsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("ElasticLogs", req.NamespacedName)
@@ -72,34 +92,96 @@ func (r *ElasticLogsReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	log.Info("Started reconciling")
 
 	metric := elasticv1.ElasticLogs{}
-	if err := r.ControllerClient.Get(ctx, req.NamespacedName, &metric); err != nil {
+	if err := r.getMetric(ctx, req.NamespacedName, &metric); err != nil {
 		if kerrors.IsNotFound(err) {
-			log.Error(err, "elastic metric not found")
+			log.Info("elastic metric not found, removing scheduled queries")
+			r.cleanup(req.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		log.Error(err, "failed to get elastic metric")
 		return reconcile.Result{}, err
 	}
 
-	passwordSecret, err := r.Clientset.CoreV1().Secrets(metric.Spec.Password.Namespace).Get(ctx, metric.Spec.Password.Name, metav1.GetOptions{})
+	if !metric.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(&metric, Finalizer) {
+			log.Info("Removing scheduled queries and series")
+			r.cleanup(req.NamespacedName)
+			controllerutil.RemoveFinalizer(&metric, Finalizer)
+			if err := r.updateMetric(ctx, &metric); err != nil {
+				log.Error(err, "failed to remove finalizer")
+				return reconcile.Result{}, err
+			}
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(&metric, Finalizer) {
+		controllerutil.AddFinalizer(&metric, Finalizer)
+		if err := r.updateMetric(ctx, &metric); err != nil {
+			log.Error(err, "failed to add finalizer")
+			return reconcile.Result{}, err
+		}
+	}
+
+	spec, err := restrictNamespace(metric.Namespace, metric.Spec)
+	if err != nil {
+		log.Error(err, "forbidden secret reference")
+		r.setFailedCondition(ctx, req.NamespacedName, elasticv1.ConditionCredentialsResolved, "NamespaceForbidden", err)
+		return reconcile.Result{}, nil
+	}
+	spec, timeouts, err := r.resolveConnection(ctx, spec)
+	if err != nil {
+		log.Error(err, "failed to resolve connection")
+		r.setFailedCondition(ctx, req.NamespacedName, elasticv1.ConditionCredentialsResolved, connectionReason(err), err)
+		return reconcile.Result{}, err
+	}
+	credentials, err := r.credentials(ctx, spec)
 	if err != nil {
-		log.Error(err, "failed to find password secret")
+		log.Error(err, "failed to resolve credentials")
+		r.setFailedCondition(ctx, req.NamespacedName, elasticv1.ConditionCredentialsResolved, secretReason(err), err)
 		return reconcile.Result{}, err
 	}
-	password, found := passwordSecret.Data[metric.Spec.Password.Key]
-	if !found {
-		err := errors.Errorf("failed to find field %s in secret %s/%s", metric.Spec.Password.Key, passwordSecret.Namespace, passwordSecret.Name)
-		log.Error(err, "failed to find field password")
+	tlsOptions, err := r.tlsOptions(ctx, spec)
+	if err != nil {
+		log.Error(err, "failed to resolve certificate authorities")
+		r.setFailedCondition(ctx, req.NamespacedName, elasticv1.ConditionCredentialsResolved, secretReason(err), err)
 		return reconcile.Result{}, err
 	}
-	elasticClient, err := query.GetClient(metric.Spec.URL, metric.Spec.Username, string(password))
+	backend, err := r.Clients.Get(req.NamespacedName.String(), spec.Type, spec.URL, credentials, tlsOptions, timeouts)
 	if err != nil {
 		log.Error(err, "failed to create elastic client")
+		r.setFailedCondition(ctx, req.NamespacedName, elasticv1.ConditionElasticReachable, "ClientFailed", err)
+		return reconcile.Result{}, err
+	}
+
+	labelsVersion, err := staticLabelsVersion(metric)
+	if err != nil {
+		log.Error(err, "failed to render static labels")
+		r.setFailedCondition(ctx, req.NamespacedName, elasticv1.ConditionReady, "InvalidLabels", err)
+		return reconcile.Result{}, err
+	}
+	version := fmt.Sprintf("%d/%s/%s", metric.Generation, query.ClientKey(spec.Type, spec.URL, credentials, tlsOptions, timeouts), labelsVersion)
+	// the queries use the endpoint of the connection
+	resolved := metric
+	resolved.Spec = spec
+	// the gauges of removed tuples, or of tuples with other labels, are
+	// unregistered before the new jobs run and register their own
+	r.MetricStore.Retain(req.NamespacedName.String(), gaugeLabels(metric))
+	if err := r.Scheduler.Schedule(req.NamespacedName.String(), version, r.jobs(backend, resolved, r.updateTupleStatus)); err != nil {
+		log.Error(err, "failed to schedule queries")
+		r.setFailedCondition(ctx, req.NamespacedName, elasticv1.ConditionReady, "ScheduleFailed", err)
 		return reconcile.Result{}, err
 	}
+	deleteInstrumentation(req.NamespacedName, metric.Spec.Tuples)
 
-	if err := r.Query(elasticClient, metric); err != nil {
-		log.Error(err, "error querying elastic")
+	err = r.updateStatus(ctx, req.NamespacedName, func(metric *elasticv1.ElasticLogs) {
+		metric.Status.ObservedGeneration = metric.Generation
+		setCondition(metric, elasticv1.ConditionCredentialsResolved, metav1.ConditionTrue, "SecretResolved", "")
+		pruneTupleStatus(metric)
+		setReadyCondition(metric)
+	})
+	if err != nil {
+		log.Error(err, "failed to update status")
 		return reconcile.Result{}, err
 	}
 
@@ -108,69 +190,410 @@ func (r *ElasticLogsReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	return ctrl.Result{}, nil
 }
 
-func (r *ElasticLogsReconciler) Query(elasticClient *elastic.Client, metric elasticv1.ElasticLogs) error {
-	log := r.Log.WithValues("ElasticLogs", types.NamespacedName{Name: metric.Name, Namespace: metric.Namespace})
+// Query sets the gauges of every tuple once, querying the tuples concurrently
+// within the limits of the Limiter, and returns the errors of the tuples that
+// failed
+func (r *ElasticLogsReconciler) Query(ctx context.Context, backend query.Backend, metric elasticv1.ElasticLogs) error {
+	name := types.NamespacedName{Name: metric.Name, Namespace: metric.Namespace}
+	log := r.Log.WithValues("ElasticLogs", name)
 
-	for _, tuple := range metric.Spec.Tuples {
-		log.Info("Query tuple %s", "name", tuple.MetricName)
-		if err := r.queryTuple(elasticClient, metric.Spec.Index, tuple); err != nil {
-			log.Error(err, "failed to query tuple", "tuple", tuple)
+	errs := make([]error, len(metric.Spec.Tuples))
+	wg := sync.WaitGroup{}
+	for i, tuple := range metric.Spec.Tuples {
+		wg.Add(1)
+		go func(i int, tuple elasticv1.Tuple) {
+			defer wg.Done()
+			log.Info("Query tuple", "name", tuple.MetricName)
+			_, warning, err := r.queryTuple(ctx, backend, metric, tuple)
+			if err != nil {
+				log.Error(err, "failed to query tuple", "tuple", tuple)
+				errs[i] = err
+				return
+			}
+			if warning != "" {
+				log.Info(warning, "tuple", tuple.MetricName)
+			}
+		}(i, tuple)
+	}
+	wg.Wait()
+
+	failed := []string{}
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", metric.Spec.Tuples[i].MetricName, err))
 		}
 	}
 
+	if len(failed) > 0 {
+		return errors.Errorf("failed to query tuples: %s", strings.Join(failed, "; "))
+	}
 	return nil
 }
 
-func (r *ElasticLogsReconciler) queryTuple(elasticClient *elastic.Client, indexName string, tuple elasticv1.Tuple) error {
-	q := query.NewQuery(elasticClient, tuple.Aggregate.Field, r.Interval)
+// tupleResultFunc is called with the result of every scheduled tuple query
+type tupleResultFunc func(name types.NamespacedName, tuple elasticv1.Tuple, start time.Time, series int, warning string, queryErr error) error
 
-	labels := []string{}
-	for k, _ := range tuple.Filters {
-		labels = append(labels, k)
+func (r *ElasticLogsReconciler) jobs(backend query.Backend, metric elasticv1.ElasticLogs, result tupleResultFunc) []scheduler.Job {
+	name := types.NamespacedName{Name: metric.Name, Namespace: metric.Namespace}
+	log := r.Log.WithValues("ElasticLogs", name)
+
+	jobs := []scheduler.Job{}
+	for _, tuple := range metric.Spec.Tuples {
+		tuple := tuple
+		job := scheduler.Job{
+			Name:     tuple.MetricName,
+			Interval: r.Interval,
+			Schedule: tuple.Schedule,
+			Run: func(ctx context.Context) {
+				log.Info("Query tuple", "name", tuple.MetricName)
+				start := time.Now()
+				series, warning, err := r.queryTuple(ctx, backend, metric, tuple)
+				if ctx.Err() != nil {
+					// the ElasticLogs was removed or the exporter is stopping
+					log.Info("Query cancelled", "name", tuple.MetricName)
+					return
+				}
+				if err != nil {
+					log.Error(err, "failed to query tuple", "tuple", tuple)
+				}
+				if err := result(name, tuple, start, series, warning, err); err != nil {
+					log.Error(err, "failed to update status", "tuple", tuple.MetricName)
+				}
+			},
+		}
+		if tuple.Interval != nil {
+			job.Interval = tuple.Interval.Duration
+		} else if metric.Spec.Interval != nil {
+			job.Interval = metric.Spec.Interval.Duration
+		}
+		if job.Schedule == "" && tuple.Interval == nil {
+			job.Schedule = metric.Spec.Schedule
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func (r *ElasticLogsReconciler) updateTupleStatus(name types.NamespacedName, tuple elasticv1.Tuple, start time.Time, series int, warning string, queryErr error) error {
+	tupleStatus := elasticv1.TupleStatus{
+		MetricName:  tuple.MetricName,
+		Series:      series,
+		Duration:    &metav1.Duration{Duration: time.Since(start)},
+		LastRunTime: &metav1.Time{Time: start},
+		Warning:     warning,
+	}
+	if queryErr != nil {
+		tupleStatus.LastError = queryErr.Error()
+	}
+
+	return r.updateStatus(context.Background(), name, func(metric *elasticv1.ElasticLogs) {
+		setTupleStatus(metric, tupleStatus)
+		switch {
+		case queryErr == nil:
+			metric.Status.LastSuccessfulQueryTime = &metav1.Time{Time: time.Now()}
+			setCondition(metric, elasticv1.ConditionElasticReachable, metav1.ConditionTrue, "QuerySucceeded", "")
+		case isConnectionError(queryErr):
+			setCondition(metric, elasticv1.ConditionElasticReachable, metav1.ConditionFalse, "ConnectionFailed", queryErr.Error())
+		default:
+			setCondition(metric, elasticv1.ConditionElasticReachable, metav1.ConditionTrue, "ErrorResponse", "")
+		}
+		setReadyCondition(metric)
+	})
+}
+
+// setFailedCondition marks conditionType and Ready as failed with err
+func (r *ElasticLogsReconciler) setFailedCondition(ctx context.Context, name types.NamespacedName, conditionType, reason string, err error) {
+	updateErr := r.updateStatus(ctx, name, func(metric *elasticv1.ElasticLogs) {
+		setCondition(metric, conditionType, metav1.ConditionFalse, reason, err.Error())
+		setCondition(metric, elasticv1.ConditionReady, metav1.ConditionFalse, reason, err.Error())
+	})
+	if updateErr != nil {
+		r.Log.Error(updateErr, "failed to update status", "ElasticLogs", name)
+	}
+}
+
+// queryTuple sets the gauge of the tuple within its timeout and records the
+// duration, errors, searches and series of the query. Queries cancelled with
+// ctx are not recorded.
+func (r *ElasticLogsReconciler) queryTuple(ctx context.Context, backend query.Backend, metric elasticv1.ElasticLogs, tuple elasticv1.Tuple) (int, string, error) {
+	name := types.NamespacedName{Name: metric.Name, Namespace: metric.Namespace}
+	queryCtx, cancel := context.WithTimeout(ctx, r.tupleTimeout(metric.Spec, tuple))
+	defer cancel()
+
+	start := time.Now()
+	series, searches, warning, err := r.setTupleGauge(queryCtx, backend, metric, tuple)
+	if ctx.Err() != nil {
+		return 0, "", ctx.Err()
 	}
-	labels = append(labels, aggregateName(tuple.Aggregate.Name))
-	gauge := r.MetricStore.GetGauge(tuple.MetricName, labels)
-
-	err := query.AllCombinations(elasticClient, indexName, tuple.Filters, func(fieldValues map[string]query.Filter) {
-		filters := map[string]string{}
-		logPairs := []interface{}{}
-		commonLabelMap := map[string]string{}
-		for label, v := range fieldValues {
-			filters[v.Field] = v.Value
-			commonLabelMap[label] = v.Value
-			logPairs = append(logPairs, v.Field)
-			logPairs = append(logPairs, v.Value)
-		}
-		r.Log.Info("Query", logPairs...)
-		results, err := q.Query(context.Background(), indexName, filters)
+	observeTupleQuery(name, tuple.MetricName, time.Since(start), searches, series, err)
+	return series, warning, err
+}
+
+// setTupleGauge sets the gauge of the tuple, owned by the ElasticLogs, to the
+// latest document counts and returns the number of series and searches and a
+// warning when the results were truncated
+func (r *ElasticLogsReconciler) setTupleGauge(ctx context.Context, backend query.Backend, metric elasticv1.ElasticLogs, tuple elasticv1.Tuple) (int, int, string, error) {
+	owner := types.NamespacedName{Name: metric.Name, Namespace: metric.Namespace}.String()
+	spec := metric.Spec
+	q, err := r.tupleQuery(backend, spec, tuple)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if r.LogQueries {
+		body, err := q.Explain(spec.Index, map[string]string{})
 		if err != nil {
-			r.Log.Error(err, "failed to query", logPairs...)
+			return 0, 0, "", err
 		}
+		r.Log.Info("Search request", "owner", owner, "tuple", tuple.MetricName, "index", spec.Index, "body", string(body))
+	}
 
-		for value, docCount := range results {
+	static, err := staticLabels(metric, tuple)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	gauge, err := r.MetricStore.GetGauge(owner, tuple.MetricName, tupleLabels(metric, tuple))
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	results, err := q.Query(ctx, spec.Index, map[string]string{})
+	if err != nil {
+		return 0, 0, "", errors.Wrap(err, "failed to query")
+	}
+
+	warning := ""
+	samples := []metrics.Sample{}
+	for _, series := range results {
+		if series.Other {
+			warning = fmt.Sprintf("buckets truncated to %d, documents left out are exported with the %s=\"true\" label, set paginate to export every bucket", tupleSize(tuple), otherLabel)
+		}
+		for _, value := range series.Values {
 			labelMap := map[string]string{}
-			for k, v := range commonLabelMap {
+			for k, v := range static {
+				labelMap[k] = v
+			}
+			for k, v := range series.Labels {
 				labelMap[k] = v
 			}
-			labelMap[aggregateName(tuple.Aggregate.Name)] = value
+			labelMap[aggregateName(tuple.Aggregate.Name)] = series.Key
+			labelMap[otherLabel] = ""
+			if series.Other {
+				labelMap[otherLabel] = "true"
+			}
+			if tuple.Aggregate.Type == query.MetricPercentiles {
+				labelMap[quantileLabel] = value.Quantile
+			}
 
-			gauge.Set(labelMap, docCount)
+			samples = append(samples, metrics.Sample{Labels: labelMap, Value: value.Value})
 		}
-	})
+	}
 
+	gauge.Set(owner, samples)
+	return len(samples), q.Searches(), warning, nil
+}
+
+// Explain returns the body of the search request of the tuple, without
+// connecting to the backend
+func (r *ElasticLogsReconciler) Explain(spec elasticv1.ElasticLogsSpec, tuple elasticv1.Tuple) ([]byte, error) {
+	// the url of specs referencing a connection is not known, and explaining
+	// does not send requests
+	backend, err := query.NewExplainBackend(spec.Type)
 	if err != nil {
-		return errors.Wrap(err, "failed to run all combinations")
+		return nil, err
 	}
-	return nil
+	q, err := r.tupleQuery(backend, spec, tuple)
+	if err != nil {
+		return nil, err
+	}
+	return q.Explain(spec.Index, map[string]string{})
+}
+
+func (r *ElasticLogsReconciler) tupleQuery(backend query.Backend, spec elasticv1.ElasticLogsSpec, tuple elasticv1.Tuple) (*query.Query, error) {
+	metric, err := tupleMetric(tuple)
+	if err != nil {
+		return nil, err
+	}
+	timeField, window, offset := r.tupleWindow(spec, tuple)
+	q := query.NewQuery(backend, tuple.Aggregate.Field, window).
+		WithWindow(timeField, offset).
+		WithMetric(metric).
+		WithGroups(query.GroupsFromFilters(tuple.Filters)...).
+		WithSize(tuple.Size).
+		WithPagination(tuple.Paginate).
+		WithFilter(tupleFilter(tuple)).
+		WithLimiter(r.Limiter, query.ClusterKey(spec.Type, spec.URL))
+	return q, nil
+}
+
+// tupleWindow returns the time field, window and offset of the tuple, falling
+// back to the ones of the spec and then to the defaults
+func (r *ElasticLogsReconciler) tupleWindow(spec elasticv1.ElasticLogsSpec, tuple elasticv1.Tuple) (string, time.Duration, time.Duration) {
+	timeField := spec.TimeField
+	if tuple.TimeField != "" {
+		timeField = tuple.TimeField
+	}
+
+	window := r.Interval
+	if tuple.Window != nil {
+		window = tuple.Window.Duration
+	} else if spec.Window != nil {
+		window = spec.Window.Duration
+	}
+
+	offset := time.Duration(0)
+	if tuple.Offset != nil {
+		offset = tuple.Offset.Duration
+	} else if spec.Offset != nil {
+		offset = spec.Offset.Duration
+	}
+
+	return timeField, window, offset
+}
+
+// tupleTimeout returns the timeout of the queries of the tuple, falling back
+// to the one of the spec and then to the interval between the queries
+func (r *ElasticLogsReconciler) tupleTimeout(spec elasticv1.ElasticLogsSpec, tuple elasticv1.Tuple) time.Duration {
+	switch {
+	case tuple.Timeout != nil:
+		return tuple.Timeout.Duration
+	case spec.Timeout != nil:
+		return spec.Timeout.Duration
+	case tuple.Interval != nil:
+		return tuple.Interval.Duration
+	case spec.Interval != nil:
+		return spec.Interval.Duration
+	}
+	return r.Interval
+}
+
+func tupleSize(tuple elasticv1.Tuple) int {
+	if tuple.Size > 0 {
+		return tuple.Size
+	}
+	return query.DefaultSize
 }
 
 func (r *ElasticLogsReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.ControllerClient = mgr.GetClient()
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&elasticv1.ElasticLogs{}).
+	if err := mgr.Add(r.Scheduler); err != nil {
+		return errors.Wrap(err, "failed to add scheduler to manager")
+	}
+	for _, object := range []client.Object{&elasticv1.ElasticLogs{}, &elasticv1.NamespacedElasticLogs{}, &elasticv1.ElasticsearchConnection{}} {
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), object, secretIndex, secretRefs); err != nil {
+			return errors.Wrap(err, "failed to index secret references")
+		}
+	}
+	for _, object := range []client.Object{&elasticv1.ElasticLogs{}, &elasticv1.NamespacedElasticLogs{}} {
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), object, connectionIndex, connectionRefs); err != nil {
+			return errors.Wrap(err, "failed to index connection references")
+		}
+	}
+	// status updates of the tuple queries do not change the queries, the
+	// labels and annotations are used by the templates of static labels
+	metadataChanged := builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{}, predicate.AnnotationChangedPredicate{}))
+	err := ctrl.NewControllerManagedBy(mgr).
+		For(&elasticv1.ElasticLogs{}, metadataChanged).
+		Watches(&source.Kind{Type: &elasticv1.NamespacedElasticLogs{}}, &handler.EnqueueRequestForObject{}, metadataChanged).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.secretRequests)).
+		// status updates of connections do not change the queries
+		Watches(&source.Kind{Type: &elasticv1.ElasticsearchConnection{}}, handler.EnqueueRequestsFromMapFunc(r.connectionRequests), builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
+	if err != nil {
+		return err
+	}
+	// the status updates of probes would otherwise requeue the connection
+	// before the probe interval
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&elasticv1.ElasticsearchConnection{}, metadataChanged).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.secretConnectionRequests)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Complete(&connectionReconciler{r})
 }
 
 func aggregateName(label string) string {
 	return label
 }
+
+// cleanup stops the queries of an ElasticLogs and deletes the series it owns
+func (r *ElasticLogsReconciler) cleanup(name types.NamespacedName) {
+	r.Scheduler.Remove(name.String())
+	r.MetricStore.Delete(name.String())
+	r.Clients.Release(name.String())
+	deleteInstrumentation(name, nil)
+}
+
+// gaugeLabels returns the label names of the gauge of every tuple
+func gaugeLabels(metric elasticv1.ElasticLogs) map[string][]string {
+	gauges := map[string][]string{}
+	for _, tuple := range metric.Spec.Tuples {
+		gauges[tuple.MetricName] = tupleLabels(metric, tuple)
+	}
+	return gauges
+}
+
+func tupleLabels(metric elasticv1.ElasticLogs, tuple elasticv1.Tuple) []string {
+	labels := []string{}
+	for k := range tuple.Filters {
+		labels = append(labels, k)
+	}
+	if metric.Namespace != "" {
+		labels = append(labels, namespaceLabel)
+	}
+	for k := range metric.Spec.StaticLabels {
+		if _, found := tuple.StaticLabels[k]; !found {
+			labels = append(labels, k)
+		}
+	}
+	for k := range tuple.StaticLabels {
+		labels = append(labels, k)
+	}
+	if tuple.Aggregate.Type == query.MetricPercentiles {
+		labels = append(labels, quantileLabel)
+	}
+	return append(labels, otherLabel, aggregateName(tuple.Aggregate.Name))
+}
+
+// tupleFilter returns the filter of the query block of the tuple
+func tupleFilter(tuple elasticv1.Tuple) query.Filter {
+	filter := query.Filter{}
+	if tuple.Query == nil {
+		return filter
+	}
+	filter.QueryString = tuple.Query.QueryString
+	filter.Must = clauses(tuple.Query.Must)
+	filter.MustNot = clauses(tuple.Query.MustNot)
+	return filter
+}
+
+func clauses(clauses []elasticv1.Clause) []query.Clause {
+	result := []query.Clause{}
+	for _, clause := range clauses {
+		c := query.Clause{
+			Field:    clause.Field,
+			Term:     clause.Term,
+			Wildcard: clause.Wildcard,
+			Exists:   clause.Exists,
+		}
+		if clause.Range != nil {
+			c.Range = &query.Range{Gt: clause.Range.Gt, Gte: clause.Range.Gte, Lt: clause.Range.Lt, Lte: clause.Range.Lte}
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func tupleMetric(tuple elasticv1.Tuple) (query.Metric, error) {
+	metric := query.Metric{
+		Type:  tuple.Aggregate.Type,
+		Field: tuple.Aggregate.ValueField,
+	}
+	for _, percent := range tuple.Aggregate.Percents {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil {
+			return metric, errors.Wrapf(err, "invalid percent %s", percent)
+		}
+		metric.Percents = append(metric.Percents, value)
+	}
+	return metric, nil
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Reasons of the query errors counter
+const (
+	errorReasonAuth       = "auth"
+	errorReasonTimeout    = "timeout"
+	errorReasonMapping    = "mapping"
+	errorReason5xx        = "5xx"
+	errorReasonConnection = "connection"
+	errorReasonOther      = "other"
+)
+
+var errorReasons = []string{errorReasonAuth, errorReasonTimeout, errorReasonMapping, errorReason5xx, errorReasonConnection, errorReasonOther}
+
+var tupleLabelNames = []string{"namespace", "name", "tuple"}
+
+var (
+	queryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "logs_exporter_query_duration_seconds",
+			Help:    "Duration of the queries of a tuple",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		},
+		tupleLabelNames,
+	)
+	queryErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "logs_exporter_query_errors_total",
+			Help: "Number of failed queries of a tuple by reason",
+		},
+		[]string{"namespace", "name", "tuple", "reason"},
+	)
+	querySearches = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "logs_exporter_query_searches",
+			Help: "Number of search requests sent by the last query of a tuple",
+		},
+		tupleLabelNames,
+	)
+	querySeries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "logs_exporter_query_series",
+			Help: "Number of series set by the last successful query of a tuple",
+		},
+		tupleLabelNames,
+	)
+	lastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "logs_exporter_last_success_timestamp_seconds",
+			Help: "Time of the last successful query of a tuple",
+		},
+		tupleLabelNames,
+	)
+
+	// instrumentedTuples are the tuple names with instrumentation series,
+	// by ElasticLogs
+	instrumentedTuples     = map[types.NamespacedName]map[string]bool{}
+	instrumentedTuplesLock = &sync.Mutex{}
+)
+
+func init() {
+	metrics.Registry.MustRegister(queryDuration, queryErrors, querySearches, querySeries, lastSuccess)
+}
+
+// observeTupleQuery records the result of a query of a tuple
+func observeTupleQuery(name types.NamespacedName, tuple string, duration time.Duration, searches, series int, err error) {
+	instrumentedTuplesLock.Lock()
+	if instrumentedTuples[name] == nil {
+		instrumentedTuples[name] = map[string]bool{}
+	}
+	instrumentedTuples[name][tuple] = true
+	instrumentedTuplesLock.Unlock()
+
+	labels := prometheus.Labels{"namespace": name.Namespace, "name": name.Name, "tuple": tuple}
+	queryDuration.With(labels).Observe(duration.Seconds())
+	querySearches.With(labels).Set(float64(searches))
+	if err != nil {
+		queryErrors.MustCurryWith(labels).WithLabelValues(errorReason(err)).Inc()
+		return
+	}
+	querySeries.With(labels).Set(float64(series))
+	lastSuccess.With(labels).SetToCurrentTime()
+}
+
+// deleteInstrumentation deletes the instrumentation series of the tuples of
+// the ElasticLogs that are not in tuples
+func deleteInstrumentation(name types.NamespacedName, tuples []elasticv1.Tuple) {
+	keep := map[string]bool{}
+	for _, tuple := range tuples {
+		keep[tuple.MetricName] = true
+	}
+
+	instrumentedTuplesLock.Lock()
+	defer instrumentedTuplesLock.Unlock()
+
+	for tuple := range instrumentedTuples[name] {
+		if keep[tuple] {
+			continue
+		}
+		labels := prometheus.Labels{"namespace": name.Namespace, "name": name.Name, "tuple": tuple}
+		queryDuration.Delete(labels)
+		querySearches.Delete(labels)
+		querySeries.Delete(labels)
+		lastSuccess.Delete(labels)
+		for _, reason := range errorReasons {
+			queryErrors.MustCurryWith(labels).DeleteLabelValues(reason)
+		}
+		delete(instrumentedTuples[name], tuple)
+	}
+	if len(instrumentedTuples[name]) == 0 {
+		delete(instrumentedTuples, name)
+	}
+}
+
+// errorReason classifies a query error for the query errors counter
+func errorReason(err error) string {
+	cause := errors.Cause(err)
+	if cause == context.DeadlineExceeded {
+		return errorReasonTimeout
+	}
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return errorReasonTimeout
+	}
+	if isConnectionError(err) {
+		return errorReasonConnection
+	}
+	status := 0
+	switch cause := cause.(type) {
+	case *elastic.Error:
+		status = cause.Status
+	case *query.HTTPError:
+		status = cause.StatusCode
+	}
+	switch {
+	case status == 401 || status == 403:
+		return errorReasonAuth
+	case status == 400:
+		return errorReasonMapping
+	case status >= 500:
+		return errorReason5xx
+	}
+	return errorReasonOther
+}
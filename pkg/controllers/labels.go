@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"text/template"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/pkg/errors"
+)
+
+// staticLabels returns the static labels of the tuple, merged with the ones of
+// the spec, with their values executed as templates on the metadata of the
+// ElasticLogs
+func staticLabels(metric elasticv1.ElasticLogs, tuple elasticv1.Tuple) (map[string]string, error) {
+	templates := map[string]string{}
+	for name, value := range metric.Spec.StaticLabels {
+		templates[name] = value
+	}
+	for name, value := range tuple.StaticLabels {
+		templates[name] = value
+	}
+	if metric.Namespace != "" {
+		if _, found := templates[namespaceLabel]; found {
+			return nil, errors.Errorf("static label %s is reserved for the namespace of NamespacedElasticLogs", namespaceLabel)
+		}
+		if _, found := tuple.Filters[namespaceLabel]; found || aggregateName(tuple.Aggregate.Name) == namespaceLabel {
+			return nil, errors.Errorf("label %s of tuple %s is reserved for the namespace of NamespacedElasticLogs", namespaceLabel, tuple.MetricName)
+		}
+		templates[namespaceLabel] = "{{ .Namespace }}"
+	}
+
+	labels := map[string]string{}
+	for name, text := range templates {
+		if _, found := tuple.Filters[name]; found || name == aggregateName(tuple.Aggregate.Name) || name == quantileLabel || name == otherLabel {
+			return nil, errors.Errorf("static label %s of tuple %s conflicts with a filter or aggregate label", name, tuple.MetricName)
+		}
+		// missing labels and annotations are rendered empty
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template of static label %s", name)
+		}
+		value := bytes.Buffer{}
+		if err := tmpl.Execute(&value, metric.ObjectMeta); err != nil {
+			return nil, errors.Wrapf(err, "failed to execute template of static label %s", name)
+		}
+		labels[name] = value.String()
+	}
+	return labels, nil
+}
+
+// staticLabelsVersion returns a hash of the static labels of every tuple, so
+// that changes of the labels and annotations they reference reschedule the
+// queries
+func staticLabelsVersion(metric elasticv1.ElasticLogs) (string, error) {
+	labels := map[string]map[string]string{}
+	for _, tuple := range metric.Spec.Tuples {
+		tupleLabels, err := staticLabels(metric, tuple)
+		if err != nil {
+			return "", err
+		}
+		labels[tuple.MetricName] = tupleLabels
+	}
+	// maps are encoded with sorted keys
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode static labels")
+	}
+	hasher := md5.New()
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// namespaceLabel holds the namespace of a NamespacedElasticLogs on the series
+// it exports. It is not namespace, which tuples commonly aggregate or filter
+// on, as Prometheus prefixes scraped labels clashing with target labels.
+const namespaceLabel = "exported_namespace"
+
+// The reconciler handles ElasticLogs and NamespacedElasticLogs as ElasticLogs,
+// telling them apart by their namespace as only NamespacedElasticLogs have
+// one.
+
+// newObject returns an empty ElasticLogs, or NamespacedElasticLogs for names
+// with a namespace
+func newObject(name types.NamespacedName) client.Object {
+	if name.Namespace == "" {
+		return &elasticv1.ElasticLogs{}
+	}
+	return &elasticv1.NamespacedElasticLogs{}
+}
+
+// asElasticLogs returns an ElasticLogs or NamespacedElasticLogs as an
+// ElasticLogs
+func asElasticLogs(object client.Object) elasticv1.ElasticLogs {
+	if namespaced, ok := object.(*elasticv1.NamespacedElasticLogs); ok {
+		return elasticv1.ElasticLogs{
+			ObjectMeta: namespaced.ObjectMeta,
+			Spec:       namespaced.Spec,
+			Status:     namespaced.Status,
+		}
+	}
+	return *object.(*elasticv1.ElasticLogs)
+}
+
+// asObject returns the ElasticLogs or NamespacedElasticLogs of metric
+func asObject(metric *elasticv1.ElasticLogs) client.Object {
+	if metric.Namespace == "" {
+		return metric
+	}
+	return &elasticv1.NamespacedElasticLogs{
+		ObjectMeta: metric.ObjectMeta,
+		Spec:       metric.Spec,
+		Status:     metric.Status,
+	}
+}
+
+// getMetric gets the ElasticLogs or NamespacedElasticLogs named name into
+// metric
+func (r *ElasticLogsReconciler) getMetric(ctx context.Context, name types.NamespacedName, metric *elasticv1.ElasticLogs) error {
+	object := newObject(name)
+	if err := r.ControllerClient.Get(ctx, name, object); err != nil {
+		return err
+	}
+	*metric = asElasticLogs(object)
+	return nil
+}
+
+// updateMetric writes the metadata and spec of metric
+func (r *ElasticLogsReconciler) updateMetric(ctx context.Context, metric *elasticv1.ElasticLogs) error {
+	object := asObject(metric)
+	if err := r.ControllerClient.Update(ctx, object); err != nil {
+		return err
+	}
+	*metric = asElasticLogs(object)
+	return nil
+}
+
+// updateMetricStatus writes the status of metric
+func (r *ElasticLogsReconciler) updateMetricStatus(ctx context.Context, metric *elasticv1.ElasticLogs) error {
+	object := asObject(metric)
+	if err := r.ControllerClient.Status().Update(ctx, object); err != nil {
+		return err
+	}
+	*metric = asElasticLogs(object)
+	return nil
+}
+
+// restrictNamespace returns the spec of a NamespacedElasticLogs or
+// ElasticsearchConnection in namespace with its secret, config map and
+// connection references defaulted to namespace, failing if they reference
+// another namespace. The spec of an ElasticLogs, whose namespace is empty, is
+// returned unchanged.
+func restrictNamespace(namespace string, spec elasticv1.ElasticLogsSpec) (elasticv1.ElasticLogsSpec, error) {
+	spec = *spec.DeepCopy()
+	if namespace == "" {
+		return spec, nil
+	}
+
+	namespaces := []*string{&spec.Password.Namespace}
+	if spec.Connection != nil {
+		namespaces = append(namespaces, &spec.Connection.Namespace)
+	}
+	if auth := spec.Auth; auth != nil {
+		for _, ref := range []*elasticv1.SecretRef{auth.APIKey, auth.Token, auth.ClientCert, auth.ClientKey} {
+			if ref != nil {
+				namespaces = append(namespaces, &ref.Namespace)
+			}
+		}
+	}
+	if spec.TLS != nil && spec.TLS.CASecret != nil {
+		namespaces = append(namespaces, &spec.TLS.CASecret.Namespace)
+	}
+	if spec.TLS != nil && spec.TLS.CAConfigMap != nil {
+		namespaces = append(namespaces, &spec.TLS.CAConfigMap.Namespace)
+	}
+
+	for _, refNamespace := range namespaces {
+		if *refNamespace != "" && *refNamespace != namespace {
+			return spec, errors.Errorf("cannot reference namespace %s from namespace %s", *refNamespace, namespace)
+		}
+		*refNamespace = namespace
+	}
+	return spec, nil
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+)
+
+func TestRestrictNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		spec      elasticv1.ElasticLogsSpec
+		err       string
+		// namespaces of the password, api key, CA secret, CA config map and
+		// connection after restricting
+		expected []string
+	}{
+		{
+			name:      "cluster scoped references are unchanged",
+			namespace: "",
+			spec: elasticv1.ElasticLogsSpec{
+				Password:   elasticv1.SecretRef{Name: "password", Namespace: "platform"},
+				Auth:       &elasticv1.Auth{APIKey: &elasticv1.SecretRef{Name: "key", Namespace: "team-b"}},
+				TLS:        &elasticv1.TLS{CASecret: &elasticv1.SecretRef{Name: "ca"}, CAConfigMap: &elasticv1.ConfigMapRef{Name: "ca", Namespace: "certs"}},
+				Connection: &elasticv1.ConnectionRef{Name: "logs", Namespace: "platform"},
+			},
+			expected: []string{"platform", "team-b", "", "certs", "platform"},
+		},
+		{
+			name:      "references default to the namespace",
+			namespace: "team-a",
+			spec: elasticv1.ElasticLogsSpec{
+				Password:   elasticv1.SecretRef{Name: "password"},
+				Auth:       &elasticv1.Auth{APIKey: &elasticv1.SecretRef{Name: "key"}},
+				TLS:        &elasticv1.TLS{CASecret: &elasticv1.SecretRef{Name: "ca"}, CAConfigMap: &elasticv1.ConfigMapRef{Name: "ca"}},
+				Connection: &elasticv1.ConnectionRef{Name: "logs"},
+			},
+			expected: []string{"team-a", "team-a", "team-a", "team-a", "team-a"},
+		},
+		{
+			name:      "references to the namespace",
+			namespace: "team-a",
+			spec: elasticv1.ElasticLogsSpec{
+				Password: elasticv1.SecretRef{Name: "password", Namespace: "team-a"},
+				Auth:     &elasticv1.Auth{APIKey: &elasticv1.SecretRef{Name: "key", Namespace: "team-a"}},
+			},
+			expected: []string{"team-a", "team-a", "", "", ""},
+		},
+		{
+			name:      "password of another namespace",
+			namespace: "team-a",
+			spec:      elasticv1.ElasticLogsSpec{Password: elasticv1.SecretRef{Name: "password", Namespace: "team-b"}},
+			err:       "cannot reference namespace team-b from namespace team-a",
+		},
+		{
+			name:      "api key of another namespace",
+			namespace: "team-a",
+			spec:      elasticv1.ElasticLogsSpec{Auth: &elasticv1.Auth{APIKey: &elasticv1.SecretRef{Name: "key", Namespace: "team-b"}}},
+			err:       "cannot reference namespace team-b",
+		},
+		{
+			name:      "token of another namespace",
+			namespace: "team-a",
+			spec:      elasticv1.ElasticLogsSpec{Auth: &elasticv1.Auth{Token: &elasticv1.SecretRef{Name: "token", Namespace: "team-b"}}},
+			err:       "cannot reference namespace team-b",
+		},
+		{
+			name:      "client certificate of another namespace",
+			namespace: "team-a",
+			spec: elasticv1.ElasticLogsSpec{Auth: &elasticv1.Auth{
+				ClientCert: &elasticv1.SecretRef{Name: "client"},
+				ClientKey:  &elasticv1.SecretRef{Name: "client", Namespace: "team-b"},
+			}},
+			err: "cannot reference namespace team-b",
+		},
+		{
+			name:      "CA secret of another namespace",
+			namespace: "team-a",
+			spec:      elasticv1.ElasticLogsSpec{TLS: &elasticv1.TLS{CASecret: &elasticv1.SecretRef{Name: "ca", Namespace: "team-b"}}},
+			err:       "cannot reference namespace team-b",
+		},
+		{
+			name:      "CA config map of another namespace",
+			namespace: "team-a",
+			spec:      elasticv1.ElasticLogsSpec{TLS: &elasticv1.TLS{CAConfigMap: &elasticv1.ConfigMapRef{Name: "ca", Namespace: "team-b"}}},
+			err:       "cannot reference namespace team-b",
+		},
+		{
+			name:      "connection of another namespace",
+			namespace: "team-a",
+			spec:      elasticv1.ElasticLogsSpec{Connection: &elasticv1.ConnectionRef{Name: "logs", Namespace: "platform"}},
+			err:       "cannot reference namespace platform",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, err := restrictNamespace(test.namespace, test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := refNamespaces(spec); strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("expected namespaces %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRestrictNamespaceCopiesSpec(t *testing.T) {
+	spec := elasticv1.ElasticLogsSpec{Auth: &elasticv1.Auth{APIKey: &elasticv1.SecretRef{Name: "key"}}}
+	if _, err := restrictNamespace("team-a", spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Auth.APIKey.Namespace != "" {
+		t.Errorf("expected the spec of the object to be unchanged, got namespace %s", spec.Auth.APIKey.Namespace)
+	}
+}
+
+// refNamespaces returns the namespaces of the password, api key, CA secret,
+// CA config map and connection of spec, empty when they are not set
+func refNamespaces(spec elasticv1.ElasticLogsSpec) []string {
+	namespaces := []string{spec.Password.Namespace, "", "", "", ""}
+	if spec.Auth != nil && spec.Auth.APIKey != nil {
+		namespaces[1] = spec.Auth.APIKey.Namespace
+	}
+	if spec.TLS != nil && spec.TLS.CASecret != nil {
+		namespaces[2] = spec.TLS.CASecret.Namespace
+	}
+	if spec.TLS != nil && spec.TLS.CAConfigMap != nil {
+		namespaces[3] = spec.TLS.CAConfigMap.Namespace
+	}
+	if spec.Connection != nil {
+		namespaces[4] = spec.Connection.Namespace
+	}
+	return namespaces
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Export schedules the tuples of metric with the given credentials instead of
+// the secrets it references, without updating its status. It runs the
+// exporter outside of kubernetes.
+func (r *ElasticLogsReconciler) Export(metric elasticv1.ElasticLogs, credentials query.Credentials, tlsOptions query.TLS) error {
+	name := types.NamespacedName{Namespace: metric.Namespace, Name: metric.Name}
+	backend, err := r.Clients.Get(name.String(), metric.Spec.Type, metric.Spec.URL, credentials, tlsOptions, query.Timeouts{})
+	if err != nil {
+		return err
+	}
+
+	spec, err := json.Marshal(metric.Spec)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode spec")
+	}
+	hasher := md5.New()
+	hasher.Write(spec)
+	labelsVersion, err := staticLabelsVersion(metric)
+	if err != nil {
+		return err
+	}
+	version := hex.EncodeToString(hasher.Sum(nil)) + "/" + query.ClientKey(metric.Spec.Type, metric.Spec.URL, credentials, tlsOptions, query.Timeouts{}) + "/" + labelsVersion
+
+	r.MetricStore.Retain(name.String(), gaugeLabels(metric))
+	if err := r.Scheduler.Schedule(name.String(), version, r.jobs(backend, metric, r.logTupleResult)); err != nil {
+		return errors.Wrap(err, "failed to schedule queries")
+	}
+	deleteInstrumentation(name, metric.Spec.Tuples)
+	return nil
+}
+
+// Remove stops the queries of an exported ElasticLogs and deletes its series
+func (r *ElasticLogsReconciler) Remove(name types.NamespacedName) {
+	r.cleanup(name)
+}
+
+// logTupleResult logs the warnings of tuple queries, which are otherwise
+// reported in the status of the ElasticLogs
+func (r *ElasticLogsReconciler) logTupleResult(name types.NamespacedName, tuple elasticv1.Tuple, start time.Time, series int, warning string, queryErr error) error {
+	if warning != "" {
+		r.Log.Info(warning, "ElasticLogs", name, "tuple", tuple.MetricName)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// updateStatus applies update to the latest version of the ElasticLogs and
+// writes its status back, retrying on conflicts with concurrent tuple runs
+func (r *ElasticLogsReconciler) updateStatus(ctx context.Context, name types.NamespacedName, update func(metric *elasticv1.ElasticLogs)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		metric := elasticv1.ElasticLogs{}
+		if err := r.getMetric(ctx, name, &metric); err != nil {
+			return err
+		}
+		status := metric.Status.DeepCopy()
+		update(&metric)
+		if equality.Semantic.DeepEqual(*status, metric.Status) {
+			return nil
+		}
+		return r.updateMetricStatus(ctx, &metric)
+	})
+}
+
+func setCondition(metric *elasticv1.ElasticLogs, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&metric.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: metric.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setTupleStatus replaces the status of the tuple with the same metric name
+func setTupleStatus(metric *elasticv1.ElasticLogs, tupleStatus elasticv1.TupleStatus) {
+	for i := range metric.Status.Tuples {
+		if metric.Status.Tuples[i].MetricName == tupleStatus.MetricName {
+			metric.Status.Tuples[i] = tupleStatus
+			return
+		}
+	}
+	metric.Status.Tuples = append(metric.Status.Tuples, tupleStatus)
+}
+
+// pruneTupleStatus removes the status of tuples no longer in the spec
+func pruneTupleStatus(metric *elasticv1.ElasticLogs) {
+	names := map[string]bool{}
+	for _, tuple := range metric.Spec.Tuples {
+		names[tuple.MetricName] = true
+	}
+	tuples := []elasticv1.TupleStatus{}
+	for _, tupleStatus := range metric.Status.Tuples {
+		if names[tupleStatus.MetricName] {
+			tuples = append(tuples, tupleStatus)
+		}
+	}
+	metric.Status.Tuples = tuples
+}
+
+// setReadyCondition derives the QueryFailed and Ready conditions from the
+// other conditions and the tuple statuses
+func setReadyCondition(metric *elasticv1.ElasticLogs) {
+	failed := []string{}
+	for _, tupleStatus := range metric.Status.Tuples {
+		if tupleStatus.LastError != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", tupleStatus.MetricName, tupleStatus.LastError))
+		}
+	}
+	if len(failed) > 0 {
+		setCondition(metric, elasticv1.ConditionQueryFailed, metav1.ConditionTrue, "TupleQueryFailed", strings.Join(failed, "; "))
+	} else {
+		setCondition(metric, elasticv1.ConditionQueryFailed, metav1.ConditionFalse, "TuplesQueried", "")
+	}
+
+	conditions := metric.Status.Conditions
+	switch {
+	case !meta.IsStatusConditionTrue(conditions, elasticv1.ConditionCredentialsResolved):
+		setCondition(metric, elasticv1.ConditionReady, metav1.ConditionFalse, "CredentialsNotResolved", conditionMessage(conditions, elasticv1.ConditionCredentialsResolved))
+	case meta.IsStatusConditionFalse(conditions, elasticv1.ConditionElasticReachable):
+		setCondition(metric, elasticv1.ConditionReady, metav1.ConditionFalse, "ElasticUnreachable", conditionMessage(conditions, elasticv1.ConditionElasticReachable))
+	case len(failed) > 0:
+		setCondition(metric, elasticv1.ConditionReady, metav1.ConditionFalse, "QueryFailed", conditionMessage(conditions, elasticv1.ConditionQueryFailed))
+	default:
+		setCondition(metric, elasticv1.ConditionReady, metav1.ConditionTrue, "QueriesScheduled", "")
+	}
+}
+
+func conditionMessage(conditions []metav1.Condition, conditionType string) string {
+	condition := meta.FindStatusCondition(conditions, conditionType)
+	if condition == nil {
+		return ""
+	}
+	return condition.Message
+}
+
+// isConnectionError returns true if err was caused by failing to reach
+// elasticsearch rather than by an error response
+func isConnectionError(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(net.Error); ok {
+		return true
+	}
+	return cause == elastic.ErrNoClient
+}
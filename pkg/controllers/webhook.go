@@ -0,0 +1,357 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/flanksource/logs-exporter/pkg/scheduler"
+	"github.com/prometheus/common/model"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// DefaultPasswordKey is the key of the password secret when the reference
+// has no key
+const DefaultPasswordKey = "password"
+
+// +kubebuilder:webhook:path=/mutate-metrics-flanksource-com-v1-elasticlogs,mutating=true,failurePolicy=fail,sideEffects=None,groups=metrics.flanksource.com,resources=elasticlogs;namespacedelasticlogs,verbs=create;update,versions=v1,name=melasticlogs.metrics.flanksource.com
+// +kubebuilder:webhook:path=/validate-metrics-flanksource-com-v1-elasticlogs,mutating=false,failurePolicy=fail,sideEffects=None,groups=metrics.flanksource.com,resources=elasticlogs;namespacedelasticlogs,verbs=create;update,versions=v1,name=velasticlogs.metrics.flanksource.com
+
+// SetupWebhooksWithManager serves the defaulting and validating webhooks of
+// ElasticLogs and NamespacedElasticLogs on the webhook server of the manager
+func SetupWebhooksWithManager(mgr ctrl.Manager) {
+	server := mgr.GetWebhookServer()
+	server.Register("/mutate-metrics-flanksource-com-v1-elasticlogs", &webhook.Admission{Handler: &ElasticLogsDefaulter{}})
+	server.Register("/validate-metrics-flanksource-com-v1-elasticlogs", &webhook.Admission{Handler: &ElasticLogsValidator{Client: mgr.GetClient()}})
+}
+
+// ElasticLogsDefaulter sets the defaults of the omitted fields of ElasticLogs
+type ElasticLogsDefaulter struct {
+	decoder *admission.Decoder
+}
+
+func (d *ElasticLogsDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	object, err := decodeMetric(d.decoder, req)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	switch object := object.(type) {
+	case *elasticv1.ElasticLogs:
+		defaultSpec(&object.Spec)
+	case *elasticv1.NamespacedElasticLogs:
+		defaultSpec(&object.Spec)
+	}
+	data, err := json.Marshal(object)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, data)
+}
+
+func (d *ElasticLogsDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+func defaultSpec(spec *elasticv1.ElasticLogsSpec) {
+	if spec.Type == "" {
+		spec.Type = query.BackendElasticsearch
+	}
+	if spec.Password.Name != "" && spec.Password.Key == "" {
+		spec.Password.Key = DefaultPasswordKey
+	}
+	for i := range spec.Tuples {
+		if spec.Tuples[i].Aggregate.Type == "" {
+			spec.Tuples[i].Aggregate.Type = query.MetricCount
+		}
+	}
+}
+
+// ElasticLogsValidator rejects ElasticLogs that would fail at query time or
+// export a metric already exported by another ElasticLogs with other labels
+type ElasticLogsValidator struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+func (v *ElasticLogsValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation == admissionv1.Delete {
+		return admission.Allowed("")
+	}
+	object, err := decodeMetric(v.decoder, req)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// removing the finalizer of an ElasticLogs created before the webhook
+	// or its current rules must not leave it terminating
+	if object.GetDeletionTimestamp() != nil {
+		return admission.Allowed("")
+	}
+	if req.Operation == admissionv1.Update {
+		old := newObject(types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()})
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		// updates of the metadata only do not change the queries
+		if equality.Semantic.DeepEqual(asElasticLogs(old).Spec, asElasticLogs(object).Spec) {
+			return admission.Allowed("")
+		}
+	}
+	list := elasticv1.ElasticLogsList{}
+	if err := v.Client.List(ctx, &list); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	namespacedList := elasticv1.NamespacedElasticLogsList{}
+	if err := v.Client.List(ctx, &namespacedList); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	others := list.Items
+	for i := range namespacedList.Items {
+		others = append(others, asElasticLogs(&namespacedList.Items[i]))
+	}
+	if errs := validateElasticLogs(asElasticLogs(object), others); len(errs) > 0 {
+		return admission.Denied(errs.ToAggregate().Error())
+	}
+	return admission.Allowed("")
+}
+
+func (v *ElasticLogsValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+// decodeMetric decodes the ElasticLogs or NamespacedElasticLogs of the request
+func decodeMetric(decoder *admission.Decoder, req admission.Request) (client.Object, error) {
+	var object client.Object = &elasticv1.ElasticLogs{}
+	if req.Kind.Kind == "NamespacedElasticLogs" {
+		object = &elasticv1.NamespacedElasticLogs{}
+	}
+	return object, decoder.Decode(req, object)
+}
+
+// validateElasticLogs validates metric against the other ElasticLogs of the
+// cluster
+func validateElasticLogs(metric elasticv1.ElasticLogs, others []elasticv1.ElasticLogs) field.ErrorList {
+	spec := metric.Spec
+	path := field.NewPath("spec")
+	errs := field.ErrorList{}
+
+	if spec.Connection != nil {
+		errs = append(errs, validateRef(path.Child("connection"), metric.Namespace, spec.Connection.Name, spec.Connection.Namespace)...)
+	} else if spec.URL == "" {
+		errs = append(errs, field.Required(path.Child("url"), "required without a connection"))
+	}
+	// the type of a connection is not known here
+	if spec.Index == "" && spec.Type != query.BackendLoki && spec.Connection == nil {
+		errs = append(errs, field.Required(path.Child("index"), ""))
+	}
+	if spec.Password != (elasticv1.SecretRef{}) {
+		errs = append(errs, validateSecretRef(path.Child("password"), metric.Namespace, &spec.Password)...)
+	}
+	if auth := spec.Auth; auth != nil {
+		authPath := path.Child("auth")
+		if auth.APIKey != nil && auth.Token != nil {
+			errs = append(errs, field.Forbidden(authPath.Child("token"), "only one of apiKey and token may be set"))
+		}
+		if (auth.ClientCert == nil) != (auth.ClientKey == nil) {
+			errs = append(errs, field.Required(authPath, "clientCert and clientKey must be set together"))
+		}
+		errs = append(errs, validateSecretRef(authPath.Child("apiKey"), metric.Namespace, auth.APIKey)...)
+		errs = append(errs, validateSecretRef(authPath.Child("token"), metric.Namespace, auth.Token)...)
+		errs = append(errs, validateSecretRef(authPath.Child("clientCert"), metric.Namespace, auth.ClientCert)...)
+		errs = append(errs, validateSecretRef(authPath.Child("clientKey"), metric.Namespace, auth.ClientKey)...)
+	}
+	if tls := spec.TLS; tls != nil {
+		tlsPath := path.Child("tls")
+		if tls.CASecret != nil && tls.CAConfigMap != nil {
+			errs = append(errs, field.Forbidden(tlsPath.Child("caConfigMap"), "only one of caSecret and caConfigMap may be set"))
+		}
+		errs = append(errs, validateSecretRef(tlsPath.Child("caSecret"), metric.Namespace, tls.CASecret)...)
+		if ref := tls.CAConfigMap; ref != nil {
+			errs = append(errs, validateRef(tlsPath.Child("caConfigMap"), metric.Namespace, ref.Name, ref.Namespace)...)
+		}
+	}
+	errs = append(errs, validateLabelNames(path.Child("staticLabels"), spec.StaticLabels)...)
+	errs = append(errs, validateSchedule(path, spec.Schedule, spec.Interval, spec.Window, spec.Timeout)...)
+
+	metricNames := map[string]bool{}
+	for i, tuple := range spec.Tuples {
+		tuplePath := path.Child("tuples").Index(i)
+		errs = append(errs, validateTuple(tuplePath, metric, tuple)...)
+
+		if metricNames[tuple.MetricName] {
+			errs = append(errs, field.Duplicate(tuplePath.Child("metricName"), tuple.MetricName))
+		}
+		metricNames[tuple.MetricName] = true
+
+		if other := conflictingTuple(metric, tuple, others); other != "" {
+			errs = append(errs, field.Invalid(tuplePath.Child("metricName"), tuple.MetricName, fmt.Sprintf("already exported by %s with other labels", other)))
+		}
+	}
+	return errs
+}
+
+func validateTuple(path *field.Path, metric elasticv1.ElasticLogs, tuple elasticv1.Tuple) field.ErrorList {
+	errs := field.ErrorList{}
+	if tuple.MetricName == "" {
+		errs = append(errs, field.Required(path.Child("metricName"), ""))
+	} else if !model.IsValidMetricName(model.LabelValue(tuple.MetricName)) {
+		errs = append(errs, field.Invalid(path.Child("metricName"), tuple.MetricName, "invalid prometheus metric name"))
+	}
+
+	errs = append(errs, validateLabelNames(path.Child("filters"), tuple.Filters)...)
+	for label, fieldName := range tuple.Filters {
+		if fieldName == "" {
+			errs = append(errs, field.Required(path.Child("filters").Key(label), ""))
+		}
+		if label == aggregateName(tuple.Aggregate.Name) {
+			errs = append(errs, field.Invalid(path.Child("filters").Key(label), label, "conflicts with the aggregate label"))
+		}
+		if label == quantileLabel && tuple.Aggregate.Type == query.MetricPercentiles {
+			errs = append(errs, field.Invalid(path.Child("filters").Key(label), label, "reserved for the quantile of percentiles"))
+		}
+		if label == otherLabel {
+			errs = append(errs, field.Invalid(path.Child("filters").Key(label), label, "reserved for the documents left out of truncated buckets"))
+		}
+	}
+
+	aggregatePath := path.Child("aggregate")
+	if tuple.Aggregate.Name == "" {
+		errs = append(errs, field.Required(aggregatePath.Child("name"), ""))
+	} else if !model.LabelName(tuple.Aggregate.Name).IsValid() {
+		errs = append(errs, field.Invalid(aggregatePath.Child("name"), tuple.Aggregate.Name, "invalid prometheus label name"))
+	} else if tuple.Aggregate.Name == otherLabel {
+		errs = append(errs, field.Invalid(aggregatePath.Child("name"), tuple.Aggregate.Name, "reserved for the documents left out of truncated buckets"))
+	}
+	if tuple.Aggregate.Field == "" {
+		errs = append(errs, field.Required(aggregatePath.Child("field"), ""))
+	}
+	if _, err := tupleMetric(tuple); err != nil {
+		errs = append(errs, field.Invalid(aggregatePath.Child("percents"), tuple.Aggregate.Percents, err.Error()))
+	}
+	if tuple.Aggregate.Type != "" && tuple.Aggregate.Type != query.MetricCount && tuple.Aggregate.ValueField == "" {
+		errs = append(errs, field.Required(aggregatePath.Child("valueField"), fmt.Sprintf("required by %s", tuple.Aggregate.Type)))
+	}
+	if tuple.Aggregate.Type == query.MetricCardinality && metric.Spec.Type == query.BackendLoki {
+		errs = append(errs, field.Forbidden(aggregatePath.Child("type"), "cardinality is not supported by loki"))
+	}
+
+	errs = append(errs, validateLabelNames(path.Child("staticLabels"), tuple.StaticLabels)...)
+	errs = append(errs, validateSchedule(path, tuple.Schedule, tuple.Interval, tuple.Window, tuple.Timeout)...)
+	if _, err := staticLabels(metric, tuple); err != nil {
+		errs = append(errs, field.Invalid(path.Child("staticLabels"), tuple.StaticLabels, err.Error()))
+	}
+
+	if tuple.Query != nil {
+		filter := tupleFilter(tuple)
+		for j, clause := range filter.Must {
+			if err := (query.Filter{Must: []query.Clause{clause}}).Validate(); err != nil {
+				errs = append(errs, field.Invalid(path.Child("query", "must").Index(j), clause.Field, err.Error()))
+			}
+		}
+		for j, clause := range filter.MustNot {
+			if err := (query.Filter{MustNot: []query.Clause{clause}}).Validate(); err != nil {
+				errs = append(errs, field.Invalid(path.Child("query", "mustNot").Index(j), clause.Field, err.Error()))
+			}
+		}
+		if tuple.Query.QueryString != "" && metric.Spec.Type == query.BackendLoki {
+			errs = append(errs, field.Forbidden(path.Child("query", "queryString"), "not supported by loki"))
+		}
+	}
+	return errs
+}
+
+// validateSchedule checks the cron expression and durations of a spec or
+// tuple, omitted ones are inherited
+func validateSchedule(path *field.Path, schedule string, interval, window, timeout *metav1.Duration) field.ErrorList {
+	errs := field.ErrorList{}
+	if schedule != "" {
+		if err := scheduler.ValidateSchedule(schedule); err != nil {
+			errs = append(errs, field.Invalid(path.Child("schedule"), schedule, err.Error()))
+		}
+	}
+	durations := []struct {
+		name     string
+		duration *metav1.Duration
+	}{{"interval", interval}, {"window", window}, {"timeout", timeout}}
+	for _, d := range durations {
+		if d.duration != nil && d.duration.Duration <= 0 {
+			errs = append(errs, field.Invalid(path.Child(d.name), d.duration.Duration.String(), "must be positive"))
+		}
+	}
+	return errs
+}
+
+func validateSecretRef(path *field.Path, namespace string, ref *elasticv1.SecretRef) field.ErrorList {
+	if ref == nil {
+		return field.ErrorList{}
+	}
+	return validateRef(path, namespace, ref.Name, ref.Namespace)
+}
+
+// validateRef checks that an ElasticLogs references secrets, config maps and
+// connections by name and namespace, and that a NamespacedElasticLogs, whose namespace is
+// set, only references its own namespace
+func validateRef(path *field.Path, namespace, refName, refNamespace string) field.ErrorList {
+	errs := field.ErrorList{}
+	if refName == "" {
+		errs = append(errs, field.Required(path.Child("name"), ""))
+	}
+	switch {
+	case namespace == "" && refNamespace == "":
+		errs = append(errs, field.Required(path.Child("namespace"), ""))
+	case namespace != "" && refNamespace != "" && refNamespace != namespace:
+		errs = append(errs, field.Forbidden(path.Child("namespace"), "cannot reference another namespace"))
+	}
+	return errs
+}
+
+func validateLabelNames(path *field.Path, labels map[string]string) field.ErrorList {
+	errs := field.ErrorList{}
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			errs = append(errs, field.Invalid(path.Key(name), name, "invalid prometheus label name"))
+		}
+	}
+	return errs
+}
+
+// conflictingTuple returns the name of another ElasticLogs exporting the
+// metric of the tuple with different label names, which the metric store
+// cannot register. ElasticLogs exporting the same metric with the same labels
+// share its gauge.
+func conflictingTuple(metric elasticv1.ElasticLogs, tuple elasticv1.Tuple, others []elasticv1.ElasticLogs) string {
+	labels := sortedLabels(tupleLabels(metric, tuple))
+	for _, other := range others {
+		if other.Name == metric.Name && other.Namespace == metric.Namespace {
+			continue
+		}
+		for _, otherTuple := range other.Spec.Tuples {
+			if otherTuple.MetricName == tuple.MetricName && sortedLabels(tupleLabels(other, otherTuple)) != labels {
+				if other.Namespace == "" {
+					return other.Name
+				}
+				return other.Namespace + "/" + other.Name
+			}
+		}
+	}
+	return ""
+}
+
+func sortedLabels(labels []string) string {
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestValidateRef(t *testing.T) {
+	tests := []struct {
+		name         string
+		namespace    string
+		refName      string
+		refNamespace string
+		expected     []string
+	}{
+		{name: "cluster scoped with a namespace", refName: "password", refNamespace: "platform"},
+		{name: "cluster scoped without a namespace", refName: "password", expected: []string{"ref.namespace"}},
+		{name: "namespaced defaults to its namespace", namespace: "team-a", refName: "password"},
+		{name: "namespaced in its namespace", namespace: "team-a", refName: "password", refNamespace: "team-a"},
+		{name: "namespaced in another namespace", namespace: "team-a", refName: "password", refNamespace: "team-b", expected: []string{"ref.namespace"}},
+		{name: "without a name", namespace: "team-a", expected: []string{"ref.name"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := validateRef(field.NewPath("ref"), test.namespace, test.refName, test.refNamespace)
+			assertFieldErrors(t, test.expected, errs)
+		})
+	}
+}
+
+func TestValidateElasticLogs(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		update    func(spec *elasticv1.ElasticLogsSpec)
+		expected  []string
+	}{
+		{
+			name:   "valid",
+			update: func(spec *elasticv1.ElasticLogsSpec) {},
+		},
+		{
+			name:     "without url or connection",
+			update:   func(spec *elasticv1.ElasticLogsSpec) { spec.URL = "" },
+			expected: []string{"spec.url"},
+		},
+		{
+			name:      "namespaced password in another namespace",
+			namespace: "team-a",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Password = elasticv1.SecretRef{Name: "password", Namespace: "team-b"}
+			},
+			expected: []string{"spec.password.namespace"},
+		},
+		{
+			name:      "namespaced references defaulting to the namespace",
+			namespace: "team-a",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Password = elasticv1.SecretRef{Name: "password"}
+				spec.Auth = &elasticv1.Auth{ClientCert: &elasticv1.SecretRef{Name: "client"}, ClientKey: &elasticv1.SecretRef{Name: "client"}}
+				spec.TLS = &elasticv1.TLS{CAConfigMap: &elasticv1.ConfigMapRef{Name: "ca"}}
+			},
+		},
+		{
+			name:      "namespaced auth in another namespace",
+			namespace: "team-a",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Auth = &elasticv1.Auth{Token: &elasticv1.SecretRef{Name: "token", Namespace: "team-b"}}
+			},
+			expected: []string{"spec.auth.token.namespace"},
+		},
+		{
+			name:      "namespaced TLS in another namespace",
+			namespace: "team-a",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.TLS = &elasticv1.TLS{
+					CASecret:    &elasticv1.SecretRef{Name: "ca", Namespace: "team-b"},
+					CAConfigMap: &elasticv1.ConfigMapRef{Name: "ca", Namespace: "team-b"},
+				}
+			},
+			expected: []string{"spec.tls.caConfigMap", "spec.tls.caSecret.namespace", "spec.tls.caConfigMap.namespace"},
+		},
+		{
+			name:      "namespaced connection in another namespace",
+			namespace: "team-a",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.URL = ""
+				spec.Connection = &elasticv1.ConnectionRef{Name: "logs", Namespace: "platform"}
+			},
+			expected: []string{"spec.connection.namespace"},
+		},
+		{
+			name: "cluster scoped password without a namespace",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Password = elasticv1.SecretRef{Name: "password"}
+			},
+			expected: []string{"spec.password.namespace"},
+		},
+		{
+			name: "api key and token",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Auth = &elasticv1.Auth{
+					APIKey: &elasticv1.SecretRef{Name: "key", Namespace: "platform"},
+					Token:  &elasticv1.SecretRef{Name: "token", Namespace: "platform"},
+				}
+			},
+			expected: []string{"spec.auth.token"},
+		},
+		{
+			name: "non-positive durations and invalid schedule",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Interval = &metav1.Duration{}
+				spec.Schedule = "every minute"
+				spec.Tuples[0].Timeout = &metav1.Duration{Duration: -time.Second}
+			},
+			expected: []string{"spec.schedule", "spec.interval", "spec.tuples[0].timeout"},
+		},
+		{
+			name: "filters clashing with the aggregate and quantile labels",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Tuples[0].Filters = map[string]string{"pod": "kubernetes.pod.name", "quantile": "quantile"}
+				spec.Tuples[0].Aggregate.Type = query.MetricPercentiles
+				spec.Tuples[0].Aggregate.ValueField = "duration"
+			},
+			expected: []string{"spec.tuples[0].filters[pod]", "spec.tuples[0].filters[quantile]"},
+		},
+		{
+			name: "duplicate metric names",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Tuples = append(spec.Tuples, spec.Tuples[0])
+			},
+			expected: []string{"spec.tuples[1].metricName"},
+		},
+		{
+			name: "cardinality on loki",
+			update: func(spec *elasticv1.ElasticLogsSpec) {
+				spec.Type = query.BackendLoki
+				spec.Tuples[0].Aggregate.Type = query.MetricCardinality
+				spec.Tuples[0].Aggregate.ValueField = "user"
+			},
+			expected: []string{"spec.tuples[0].aggregate.type"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metric := validElasticLogs(test.namespace)
+			test.update(&metric.Spec)
+			assertFieldErrors(t, test.expected, validateElasticLogs(metric, nil))
+		})
+	}
+}
+
+func TestValidateElasticLogsConflictingLabels(t *testing.T) {
+	metric := validElasticLogs("")
+	other := validElasticLogs("team-a")
+	other.Name = "other"
+
+	// the namespace label of NamespacedElasticLogs changes the labels of the
+	// metric
+	errs := validateElasticLogs(metric, []elasticv1.ElasticLogs{other})
+	assertFieldErrors(t, []string{"spec.tuples[0].metricName"}, errs)
+
+	other.Spec.Tuples[0].MetricName = "other_documents_by_pod"
+	assertFieldErrors(t, nil, validateElasticLogs(metric, []elasticv1.ElasticLogs{other}))
+}
+
+func validElasticLogs(namespace string) elasticv1.ElasticLogs {
+	metric := elasticv1.ElasticLogs{
+		Spec: elasticv1.ElasticLogsSpec{
+			Index: "logs-*",
+			URL:   "https://logs:9200",
+			Tuples: []elasticv1.Tuple{{
+				MetricName: "documents_by_pod",
+				Aggregate:  elasticv1.Pair{Name: "pod", Field: "kubernetes.pod.name", Type: query.MetricCount},
+			}},
+		},
+	}
+	metric.Name = "documents"
+	metric.Namespace = namespace
+	return metric
+}
+
+// assertFieldErrors compares the fields of errs to expected regardless of
+// their order, as maps are validated in a random order
+func assertFieldErrors(t *testing.T, expected []string, errs field.ErrorList) {
+	t.Helper()
+	actual := []string{}
+	for _, err := range errs {
+		actual = append(actual, err.Field)
+	}
+	expected = append([]string{}, expected...)
+	sort.Strings(actual)
+	sort.Strings(expected)
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected errors of %v, got %v", expected, errs)
+	}
+}
@@ -7,12 +7,19 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
 type Gauge struct {
-	gauge *prometheus.GaugeVec
+	name   string
+	labels []string
+	gauge  *prometheus.GaugeVec
+	// series set by each owner, keyed by owner and then by series hash
+	series map[string]map[string]prometheus.Labels
+	lock   *sync.Mutex
 }
 
 type GaugeLabel struct {
@@ -20,6 +27,15 @@ type GaugeLabel struct {
 	Value int64
 }
 
+// Sample is the value of a single series of a gauge
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// MetricStore collects the gauges of every tuple. It is registered as an
+// unchecked collector, as the registry never forgets the label names of an
+// unregistered metric, so that tuples can change the labels of their metric.
 type MetricStore struct {
 	gauges map[string]*Gauge
 	lock   *sync.Mutex
@@ -30,24 +46,65 @@ func NewMetricStore() *MetricStore {
 		gauges: map[string]*Gauge{},
 		lock:   &sync.Mutex{},
 	}
+	metrics.Registry.MustRegister(store)
 	return store
 }
 
-func (ms *MetricStore) GetGauge(name string, labels []string) *Gauge {
-	sort.Strings(labels)
-	hasher := md5.New()
-	hasher.Write([]byte(strings.Join(labels, "/")))
-	hash := hex.EncodeToString(hasher.Sum(nil))
+// Describe sends no descriptors, making the store an unchecked collector
+func (ms *MetricStore) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the series of every gauge
+func (ms *MetricStore) Collect(ch chan<- prometheus.Metric) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, gauge := range ms.gauges {
+		gauge.gauge.Collect(ch)
+	}
+}
+
+// GetGauge returns the gauge with the given name and label names, creating it
+// on first use, and records owner as one of its owners. It fails if a gauge
+// with the same name but different label names exists, or if another
+// collector exports the name. Invalid names are rejected here, as the store
+// is unchecked and they would otherwise fail every gather of the registry.
+func (ms *MetricStore) GetGauge(owner, name string, labels []string) (*Gauge, error) {
+	if err := validateNames(name, labels); err != nil {
+		return nil, err
+	}
+	labels = sortedLabels(labels)
+	hash := gaugeHash(name, labels)
+
+	if gauge := ms.ownGauge(owner, hash); gauge != nil {
+		return gauge, nil
+	}
+	// gathered without the lock, which the store holds while collecting.
+	// Families that failed to gather are still returned.
+	families, _ := metrics.Registry.Gather()
 
 	ms.lock.Lock()
 	defer ms.lock.Unlock()
 
 	gauge, found := ms.gauges[hash]
 	if found {
-		return gauge
+		gauge.own(owner)
+		return gauge, nil
+	}
+
+	for _, other := range ms.gauges {
+		if other.name == name {
+			return nil, errors.Errorf("metric %s is already registered with labels %v, cannot register it with labels %v", name, other.labels, labels)
+		}
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return nil, errors.Errorf("metric %s is already exported by another collector", name)
+		}
 	}
 
 	gauge = &Gauge{
+		name:   name,
+		labels: labels,
 		gauge: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: name,
@@ -55,12 +112,149 @@ func (ms *MetricStore) GetGauge(name string, labels []string) *Gauge {
 			},
 			labels,
 		),
+		series: map[string]map[string]prometheus.Labels{},
+		lock:   ms.lock,
 	}
-	metrics.Registry.MustRegister(gauge.gauge)
+	gauge.own(owner)
 	ms.gauges[hash] = gauge
+	return gauge, nil
+}
+
+// validateNames checks the metric and label names as the registry would when
+// registering the gauge
+func validateNames(name string, labels []string) error {
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return errors.Errorf("%q is not a valid metric name", name)
+	}
+	seen := map[string]bool{}
+	for _, label := range labels {
+		if !model.LabelName(label).IsValid() || strings.HasPrefix(label, model.ReservedLabelPrefix) {
+			return errors.Errorf("%q is not a valid label name of metric %s", label, name)
+		}
+		if seen[label] {
+			return errors.Errorf("duplicate label name %q of metric %s", label, name)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+// ownGauge records owner as an owner of the gauge with hash and returns it,
+// or nil if there is no such gauge
+func (ms *MetricStore) ownGauge(owner, hash string) *Gauge {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	gauge, found := ms.gauges[hash]
+	if !found {
+		return nil
+	}
+	gauge.own(owner)
 	return gauge
 }
 
-func (g *Gauge) Set(labels map[string]string, value int64) {
-	g.gauge.With(labels).Set(float64(value))
+// Delete removes every series set by owner
+func (ms *MetricStore) Delete(owner string) {
+	ms.Retain(owner, nil)
+}
+
+// Retain removes the series set by owner on every gauge that is not in gauges,
+// a map of metric names to label names. Gauges left without any owner are
+// removed.
+func (ms *MetricStore) Retain(owner string, gauges map[string][]string) {
+	keep := map[string]bool{}
+	for name, labels := range gauges {
+		keep[gaugeHash(name, sortedLabels(labels))] = true
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for hash, gauge := range ms.gauges {
+		if keep[hash] {
+			continue
+		}
+		if _, found := gauge.series[owner]; found {
+			gauge.deleteOwner(owner)
+		}
+		if len(gauge.series) == 0 {
+			delete(ms.gauges, hash)
+		}
+	}
+}
+
+// Set sets the value of every sample and deletes the series previously set
+// by owner that are not part of samples
+func (g *Gauge) Set(owner string, samples []Sample) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	previous := g.series[owner]
+	g.series[owner] = map[string]prometheus.Labels{}
+	g.add(owner, samples)
+
+	for hash, labels := range previous {
+		if _, found := g.series[owner][hash]; !found && !g.ownedByOther(owner, hash) {
+			g.gauge.Delete(labels)
+		}
+	}
+}
+
+// own records owner as an owner of the gauge, before it sets any series, so
+// that the gauge is unregistered once owner stops using it even if it never
+// set a series
+func (g *Gauge) own(owner string) {
+	if _, found := g.series[owner]; !found {
+		g.series[owner] = map[string]prometheus.Labels{}
+	}
+}
+
+func (g *Gauge) add(owner string, samples []Sample) {
+	for _, sample := range samples {
+		labels := prometheus.Labels(sample.Labels)
+		g.gauge.With(labels).Set(sample.Value)
+		g.series[owner][seriesHash(labels)] = labels
+	}
+}
+
+func (g *Gauge) deleteOwner(owner string) {
+	for hash, labels := range g.series[owner] {
+		if !g.ownedByOther(owner, hash) {
+			g.gauge.Delete(labels)
+		}
+	}
+	delete(g.series, owner)
+}
+
+func (g *Gauge) ownedByOther(owner, hash string) bool {
+	for other, series := range g.series {
+		if _, found := series[hash]; found && other != owner {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedLabels(labels []string) []string {
+	sorted := append([]string{}, labels...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// gaugeHash identifies a gauge by its name and sorted label names
+func gaugeHash(name string, labels []string) string {
+	hasher := md5.New()
+	hasher.Write([]byte(name + "/" + strings.Join(labels, "/")))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func seriesHash(labels prometheus.Labels) string {
+	pairs := []string{}
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	hasher := md5.New()
+	hasher.Write([]byte(strings.Join(pairs, "/")))
+	return hex.EncodeToString(hasher.Sum(nil))
 }
@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// gathered returns the series of the metric name in the registry, keyed by
+// the value of label
+func gathered(t *testing.T, name, label string) map[string]float64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	series := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			series[labelValue(metric, label)] = metric.GetGauge().GetValue()
+		}
+	}
+	return series
+}
+
+func labelValue(metric *dto.Metric, name string) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestGetGaugeKeysByNameAndLabels(t *testing.T) {
+	store := NewMetricStore()
+	defer store.Delete("owner")
+
+	errorsGauge, err := store.GetGauge("owner", "test_errors_by_namespace", []string{"namespace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestsGauge, err := store.GetGauge("owner", "test_requests_by_namespace", []string{"namespace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errorsGauge == requestsGauge {
+		t.Fatal("metrics with different names and the same labels share a gauge")
+	}
+	errorsGauge.Set("owner", []Sample{{Labels: map[string]string{"namespace": "default"}, Value: 1}})
+	requestsGauge.Set("owner", []Sample{{Labels: map[string]string{"namespace": "default"}, Value: 2}})
+
+	if got := gathered(t, "test_errors_by_namespace", "namespace")["default"]; got != 1 {
+		t.Errorf("expected test_errors_by_namespace to be 1, got %v", got)
+	}
+	if got := gathered(t, "test_requests_by_namespace", "namespace")["default"]; got != 2 {
+		t.Errorf("expected test_requests_by_namespace to be 2, got %v", got)
+	}
+
+	same, err := store.GetGauge("other", "test_errors_by_namespace", []string{"namespace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != errorsGauge {
+		t.Error("the same name and labels returned another gauge")
+	}
+	store.Delete("other")
+}
+
+func TestGetGaugeSortsLabels(t *testing.T) {
+	store := NewMetricStore()
+	defer store.Delete("owner")
+
+	first, err := store.GetGauge("owner", "test_sorted_labels", []string{"pod", "namespace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.GetGauge("owner", "test_sorted_labels", []string{"namespace", "pod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("the same labels in another order returned another gauge")
+	}
+}
+
+func TestGetGaugeConflictingLabels(t *testing.T) {
+	store := NewMetricStore()
+	defer store.Delete("a")
+
+	if _, err := store.GetGauge("a", "test_conflicting", []string{"namespace"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetGauge("b", "test_conflicting", []string{"pod"}); err == nil {
+		t.Fatal("expected an error registering a metric with other labels")
+	}
+
+	// the gauge is unregistered once its last owner releases it
+	store.Delete("a")
+	if _, err := store.GetGauge("b", "test_conflicting", []string{"pod"}); err != nil {
+		t.Fatalf("expected the metric to be registered with other labels, got %v", err)
+	}
+	store.Delete("b")
+}
+
+func TestRetainUnregistersGaugesWithoutSeries(t *testing.T) {
+	store := NewMetricStore()
+	defer store.Delete("owner")
+
+	// the first query of the tuple failed before setting any series
+	if _, err := store.GetGauge("owner", "test_failed_query", []string{"namespace"}); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string][]string{"test_failed_query": {"pod"}}
+	store.Retain("owner", labels)
+	if _, err := store.GetGauge("owner", "test_failed_query", []string{"pod"}); err != nil {
+		t.Fatalf("expected the metric to be registered with the new labels, got %v", err)
+	}
+}
+
+func TestRetainKeepsSeriesOfOtherOwners(t *testing.T) {
+	store := NewMetricStore()
+	defer store.Delete("b")
+
+	a, err := store.GetGauge("a", "test_shared", []string{"namespace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.GetGauge("b", "test_shared", []string{"namespace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Set("a", []Sample{{Labels: map[string]string{"namespace": "a"}, Value: 1}, {Labels: map[string]string{"namespace": "shared"}, Value: 2}})
+	b.Set("b", []Sample{{Labels: map[string]string{"namespace": "b"}, Value: 3}, {Labels: map[string]string{"namespace": "shared"}, Value: 2}})
+
+	store.Retain("a", map[string][]string{})
+	series := gathered(t, "test_shared", "namespace")
+	if _, found := series["a"]; found {
+		t.Error("expected the series of a to be deleted")
+	}
+	if series["b"] != 3 || series["shared"] != 2 {
+		t.Errorf("expected the series of b to be kept, got %v", series)
+	}
+}
+
+func TestSetDeletesPreviousSeries(t *testing.T) {
+	store := NewMetricStore()
+	defer store.Delete("owner")
+
+	gauge, err := store.GetGauge("owner", "test_previous_series", []string{"namespace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gauge.Set("owner", []Sample{{Labels: map[string]string{"namespace": "old"}, Value: 1}})
+	gauge.Set("owner", []Sample{{Labels: map[string]string{"namespace": "new"}, Value: 2}})
+
+	series := gathered(t, "test_previous_series", "namespace")
+	if _, found := series["old"]; found || series["new"] != 2 {
+		t.Errorf("expected only the new series, got %v", series)
+	}
+}
+
+func TestGetGaugeNameOfAnotherCollector(t *testing.T) {
+	other := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_other_collector", Help: "A gauge of another collector"})
+	metrics.Registry.MustRegister(other)
+	defer metrics.Registry.Unregister(other)
+
+	store := NewMetricStore()
+	defer store.Delete("owner")
+
+	if _, err := store.GetGauge("owner", "test_other_collector", []string{"namespace"}); err == nil {
+		t.Fatal("expected an error exporting a metric of another collector")
+	}
+}
+
+func TestGetGaugeInvalidNames(t *testing.T) {
+	store := NewMetricStore()
+	defer store.Delete("owner")
+
+	tests := []struct {
+		name   string
+		labels []string
+	}{
+		{name: "test-invalid-metric", labels: []string{"namespace"}},
+		{name: "test_invalid_label", labels: []string{"foo-bar"}},
+		{name: "test_reserved_label", labels: []string{"__name__"}},
+		{name: "test_duplicate_label", labels: []string{"pod", "pod"}},
+	}
+	for _, test := range tests {
+		if _, err := store.GetGauge("owner", test.name, test.labels); err == nil {
+			t.Errorf("expected an error registering %s with labels %v", test.name, test.labels)
+		}
+	}
+	if _, err := metrics.Registry.Gather(); err != nil {
+		t.Errorf("expected the registry to gather, got %v", err)
+	}
+}
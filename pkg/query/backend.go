@@ -0,0 +1,102 @@
+package query
+
+import (
+	"context"
+	"net/http"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// Backend types
+const (
+	BackendElasticsearch = "elasticsearch"
+	BackendOpenSearch    = "opensearch"
+	BackendLoki          = "loki"
+)
+
+// Backend sends search requests to and lists the indexes of a cluster
+type Backend interface {
+	// Search sends the search request to the indexes matching index
+	Search(ctx context.Context, index string, source *elastic.SearchSource) (*elastic.SearchResult, error)
+	// Indexes returns the name of every index
+	Indexes(ctx context.Context) ([]string, error)
+	// Version returns the version of the cluster
+	Version(ctx context.Context) (string, error)
+}
+
+// NewBackend returns the backend of the given type, elasticsearch when empty
+func NewBackend(backendType, url string, credentials Credentials, tlsOptions TLS, timeouts Timeouts) (Backend, error) {
+	backend, _, err := newBackend(backendType, url, credentials, tlsOptions, timeouts)
+	return backend, err
+}
+
+// NewExplainBackend returns a backend of backendType without a connection to
+// a cluster, which can only explain queries
+func NewExplainBackend(backendType string) (Backend, error) {
+	switch backendType {
+	case "", BackendElasticsearch:
+		return &elasticsearchBackend{}, nil
+	case BackendOpenSearch:
+		return &openSearchBackend{}, nil
+	case BackendLoki:
+		return &lokiBackend{}, nil
+	}
+	return nil, errors.Errorf("unsupported backend type %s", backendType)
+}
+
+// newBackend returns a backend and its transport
+func newBackend(backendType, url string, credentials Credentials, tlsOptions TLS, timeouts Timeouts) (Backend, *http.Transport, error) {
+	if backendType != "" && backendType != BackendElasticsearch && backendType != BackendOpenSearch && backendType != BackendLoki {
+		return nil, nil, errors.Errorf("unsupported backend type %s", backendType)
+	}
+	transport, err := newTransport(credentials, tlsOptions, timeouts)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpClient := &http.Client{Transport: transport, Timeout: timeouts.Request}
+
+	switch backendType {
+	case BackendOpenSearch:
+		return newOpenSearchBackend(url, credentials, httpClient), transport, nil
+	case BackendLoki:
+		return newLokiBackend(url, credentials, httpClient), transport, nil
+	}
+	client, err := newElasticClient(url, credentials, httpClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &elasticsearchBackend{client: client, url: url}, transport, nil
+}
+
+type elasticsearchBackend struct {
+	client *elastic.Client
+	url    string
+}
+
+func (b *elasticsearchBackend) Search(ctx context.Context, index string, source *elastic.SearchSource) (*elastic.SearchResult, error) {
+	return b.client.Search().
+		Index(index).
+		SearchSource(source).
+		Do(ctx)
+}
+
+func (b *elasticsearchBackend) Indexes(ctx context.Context) ([]string, error) {
+	resp, err := b.client.CatIndices().Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	indexes := []string{}
+	for _, index := range resp {
+		indexes = append(indexes, index.Index)
+	}
+	return indexes, nil
+}
+
+func (b *elasticsearchBackend) Version(ctx context.Context) (string, error) {
+	result, _, err := b.client.Ping(b.url).Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	return result.Version.Number, nil
+}
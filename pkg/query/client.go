@@ -1,25 +1,146 @@
 package query
 
 import (
+	"crypto/md5"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
 	"net/http"
+	"time"
 
 	elastic "github.com/olivere/elastic/v7"
 	"github.com/pkg/errors"
 )
 
-func GetClient(url, username, password string) (*elastic.Client, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// Credentials authenticate the client, with basic auth when Username or
+// Password is set, an ApiKey or Bearer authorization header when APIKey or
+// Token is set, and a TLS client certificate when ClientCert and ClientKey
+// are set
+type Credentials struct {
+	Username string
+	Password string
+	// APIKey is the base64 encoded id:api_key pair
+	APIKey string
+	Token  string
+	// ClientCert and ClientKey are PEM encoded
+	ClientCert []byte
+	ClientKey  []byte
+}
+
+// Hash identifies the credentials without exposing them
+func (c Credentials) Hash() string {
+	hasher := md5.New()
+	for _, value := range [][]byte{[]byte(c.Username), []byte(c.Password), []byte(c.APIKey), []byte(c.Token), c.ClientCert, c.ClientKey} {
+		hasher.Write(value)
+		hasher.Write([]byte{0})
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// TLS configures the verification of the server certificate, against the
+// PEM encoded CA bundle when set and the system certificate authorities
+// otherwise
+type TLS struct {
+	CA                 []byte
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// Hash identifies the TLS options
+func (t TLS) Hash() string {
+	hasher := md5.New()
+	hasher.Write(t.CA)
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(t.ServerName))
+	if t.InsecureSkipVerify {
+		hasher.Write([]byte{1})
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Timeouts bound the connections and requests of a backend, the defaults are
+// used when zero
+type Timeouts struct {
+	// Connect bounds establishing a connection and its TLS handshake
+	Connect time.Duration
+	// Request bounds every request, including reading the response
+	Request time.Duration
+}
+
+// DefaultConnectTimeout is the connect timeout used when none is set,
+// requests have no timeout by default
+const DefaultConnectTimeout = 10 * time.Second
+
+// ClientKey identifies the clients with the same backend, endpoint,
+// credentials, TLS options and timeouts
+func ClientKey(backendType, url string, credentials Credentials, tlsOptions TLS, timeouts Timeouts) string {
+	hasher := md5.New()
+	hasher.Write([]byte(backendType + "/" + url + "/" + credentials.Hash() + "/" + tlsOptions.Hash() + "/" + timeouts.Connect.String() + "/" + timeouts.Request.String()))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// authorization returns the authorization header of API key and token
+// credentials
+func (c Credentials) authorization() string {
+	switch {
+	case c.APIKey != "":
+		return "ApiKey " + c.APIKey
+	case c.Token != "":
+		return "Bearer " + c.Token
+	}
+	return ""
+}
+
+// newTransport returns a transport verifying the server certificate and
+// presenting the client certificate, whose idle connections are kept open for
+// reuse by the following queries
+func newTransport(credentials Credentials, tlsOptions TLS, timeouts Timeouts) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         tlsOptions.ServerName,
+		InsecureSkipVerify: tlsOptions.InsecureSkipVerify,
 	}
-	httpClient := &http.Client{Transport: tr}
+	if len(tlsOptions.CA) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(tlsOptions.CA) {
+			return nil, errors.New("failed to find any PEM certificate in the CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(credentials.ClientCert) > 0 || len(credentials.ClientKey) > 0 {
+		certificate, err := tls.X509KeyPair(credentials.ClientCert, credentials.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	connectTimeout := timeouts.Connect
+	if connectTimeout == 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: connectTimeout,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}, nil
+}
 
+func newElasticClient(url string, credentials Credentials, httpClient *http.Client) (*elastic.Client, error) {
 	options := []elastic.ClientOptionFunc{
 		elastic.SetURL(url),
 		elastic.SetMaxRetries(10),
-		elastic.SetBasicAuth(username, password),
 		elastic.SetHttpClient(httpClient),
 	}
+	if credentials.Username != "" || credentials.Password != "" {
+		options = append(options, elastic.SetBasicAuth(credentials.Username, credentials.Password))
+	}
+	if authorization := credentials.authorization(); authorization != "" {
+		options = append(options, elastic.SetHeaders(http.Header{"Authorization": []string{authorization}}))
+	}
 
 	c, err := elastic.NewSimpleClient(options...)
 
@@ -1,72 +1,141 @@
 package query
 
 import (
-	"context"
 	"fmt"
-	"time"
+	"sort"
 
 	elastic "github.com/olivere/elastic/v7"
 	"github.com/pkg/errors"
 )
 
-type Callback func(fieldValues map[string]Filter)
-
-type FieldValues struct {
-	Label  string
-	Field  string
-	Values []string
+// Group is a field whose values are exported as Label, every combination of
+// group values found in the index produces its own series
+type Group struct {
+	Label string
+	Field string
 }
 
-type Filter struct {
-	Field string
-	Value string
+// Series is the value of a bucket of the aggregated field for one combination
+// of group values, keyed by group label
+type Series struct {
+	Labels map[string]string
+	Key    string
+	Values []Value
+	// Other is set on the series counting the documents left out of a
+	// truncated terms aggregation, whose key and labels of the truncated and
+	// deeper groups are empty. It only has a value for count metrics.
+	Other bool
 }
 
-func AllCombinations(client *elastic.Client, index string, fieldsMap map[string]string, callback Callback) error {
-	allValues := []FieldValues{}
+// GroupsFromFilters returns a group for every label to field pair, sorted by
+// label so that the nested aggregations are stable across runs
+func GroupsFromFilters(filters map[string]string) []Group {
+	groups := []Group{}
+	for label, field := range filters {
+		groups = append(groups, Group{Label: label, Field: field})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Label < groups[j].Label
+	})
+	return groups
+}
 
-	if len(fieldsMap) == 0 {
-		return nil
+// nestAggregation wraps aggr in one terms aggregation per group, the first
+// group being the outermost aggregation
+func (q *Query) nestAggregation(aggr elastic.Aggregation) (string, elastic.Aggregation) {
+	name := q.aggregationName
+	for i := len(q.groups) - 1; i >= 0; i-- {
+		aggr = elastic.NewTermsAggregation().
+			Field(q.groups[i].Field).
+			Size(q.size).
+			SubAggregation(name, aggr)
+		name = groupAggregationName(q.groups[i])
 	}
+	return name, aggr
+}
 
-	for label, field := range fieldsMap {
-		values, err := getFieldValues(client, index, field)
-		if err != nil {
-			return errors.Wrapf(err, "failed to find field values for field=%s label=%s", field, label)
+// decodeGroups walks the nested group aggregations and returns a series for
+// every bucket of the aggregated field
+func (q *Query) decodeGroups(aggs elastic.Aggregations, depth int, labels map[string]string) ([]Series, error) {
+	if depth == len(q.groups) {
+		terms, found := aggs.Terms(q.aggregationName)
+		if !found {
+			return nil, errors.Errorf("aggregation %s not found", q.aggregationName)
+		}
+		series := []Series{}
+		for _, bucket := range terms.Buckets {
+			key := bucketKey(bucket)
+			values, err := q.decodeMetric(bucket.Aggregations, bucket.DocCount)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to decode %s of bucket %s", q.metric.Type, key)
+			}
+			series = append(series, Series{Labels: copyLabels(labels), Key: key, Values: values})
+		}
+		if terms.SumOfOtherDocCount > 0 {
+			series = append(series, q.otherSeries(labels, depth, terms.SumOfOtherDocCount))
 		}
-		fmt.Printf("label=%s field=%s values=%v\n", label, field, values)
-		allValues = append(allValues, FieldValues{Label: label, Field: field, Values: values})
+		return series, nil
 	}
 
-	getCombinations(allValues, callback, 0, map[string]Filter{})
+	group := q.groups[depth]
+	terms, found := aggs.Terms(groupAggregationName(group))
+	if !found {
+		return nil, errors.Errorf("aggregation for group %s not found", group.Label)
+	}
 
-	return nil
+	series := []Series{}
+	for _, bucket := range terms.Buckets {
+		labels[group.Label] = bucketKey(bucket)
+		groupSeries, err := q.decodeGroups(bucket.Aggregations, depth+1, labels)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, groupSeries...)
+	}
+	delete(labels, group.Label)
+	if terms.SumOfOtherDocCount > 0 {
+		series = append(series, q.otherSeries(labels, depth, terms.SumOfOtherDocCount))
+	}
+	return series, nil
 }
 
-func getCombinations(allValues []FieldValues, callback Callback, index int, filters map[string]Filter) {
-	if index == len(allValues) {
-		callback(filters)
-		return
+// otherSeries returns the series of the documents left out of the terms
+// aggregation at depth, with empty labels for that and deeper groups, as any
+// value could be the key of a real bucket
+func (q *Query) otherSeries(labels map[string]string, depth int, docCount int64) Series {
+	series := Series{Labels: copyLabels(labels), Values: []Value{}, Other: true}
+	for _, group := range q.groups[depth:] {
+		series.Labels[group.Label] = ""
 	}
-
-	fieldValue := allValues[index]
-
-	for i := 0; i < len(fieldValue.Values); i++ {
-		filters[fieldValue.Label] = Filter{Field: fieldValue.Field, Value: fieldValue.Values[i]}
-		getCombinations(allValues, callback, index+1, filters)
+	if q.metric.Type == MetricCount {
+		series.Values = []Value{{Value: float64(docCount)}}
 	}
+	return series
 }
 
-func getFieldValues(client *elastic.Client, index, field string) ([]string, error) {
-	query := NewQuery(client, field, 15*time.Minute)
-	results, err := query.Query(context.Background(), index, map[string]string{})
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to get field values")
+func groupAggregationName(group Group) string {
+	return "by_" + group.Label
+}
+
+// bucketKey returns the key of a terms bucket as a string, numeric and
+// boolean fields have non string keys
+func bucketKey(bucket *elastic.AggregationBucketKeyItem) string {
+	if bucket.KeyAsString != nil {
+		return *bucket.KeyAsString
+	}
+	if key, ok := bucket.Key.(string); ok {
+		return key
 	}
+	if bucket.KeyNumber != "" {
+		return bucket.KeyNumber.String()
+	}
+	return fmt.Sprintf("%v", bucket.Key)
+}
 
-	values := []string{}
-	for k, _ := range results {
-		values = append(values, k)
+func copyLabels(labels map[string]string) map[string]string {
+	copied := map[string]string{}
+	for k, v := range labels {
+		copied[k] = v
 	}
-	return values, nil
+	return copied
 }
@@ -0,0 +1,111 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// queryComposite pages through every combination of group and field values
+// with a composite aggregation, following after_key until the last page
+func (q *Query) queryComposite(ctx context.Context, indexName string, query elastic.Query) ([]Series, error) {
+	series := []Series{}
+	var after map[string]interface{}
+	for {
+		source, err := q.searchSource(query, after)
+		if err != nil {
+			return nil, err
+		}
+
+		q.searches++
+		result, err := q.client.Search(ctx, indexName, source)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get composite page")
+		}
+
+		composite, found := result.Aggregations.Composite(q.aggregationName)
+		if !found {
+			return nil, errors.Errorf("aggregation %s not found", q.aggregationName)
+		}
+		for _, bucket := range composite.Buckets {
+			keys, err := compositeKeys(bucket)
+			if err != nil {
+				return nil, err
+			}
+			labels := map[string]string{}
+			for _, group := range q.groups {
+				labels[group.Label] = keys[groupAggregationName(group)]
+			}
+			key := keys[q.aggregationName]
+			values, err := q.decodeMetric(bucket.Aggregations, bucket.DocCount)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to decode %s of bucket %s", q.metric.Type, key)
+			}
+			series = append(series, Series{Labels: labels, Key: key, Values: values})
+		}
+
+		if len(composite.Buckets) == 0 || len(composite.AfterKey) == 0 {
+			return series, nil
+		}
+		// sent back as decoded by the client, long keys would lose their
+		// precision as floats and repeat or skip pages
+		after = map[string]interface{}{}
+		if err := decodeNumbers(composite.Aggregations["after_key"], &after); err != nil {
+			return nil, errors.Wrap(err, "failed to decode composite after_key")
+		}
+	}
+}
+
+// decodeNumbers decodes data into v, keeping numbers as json.Number
+func decodeNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// compositeKeys returns the key of every source of a composite bucket as a
+// string, formatted like the keys of terms buckets. The keys are decoded again
+// as the client decodes numbers as floats.
+func compositeKeys(bucket *elastic.AggregationBucketCompositeItem) (map[string]string, error) {
+	values := map[string]interface{}{}
+	if err := decodeNumbers(bucket.Aggregations["key"], &values); err != nil {
+		return nil, errors.Wrap(err, "failed to decode composite bucket key")
+	}
+
+	keys := map[string]string{}
+	for name, value := range values {
+		item := &elastic.AggregationBucketKeyItem{Key: value}
+		if number, ok := value.(json.Number); ok {
+			item.KeyNumber = number
+		}
+		keys[name] = bucketKey(item)
+	}
+	return keys, nil
+}
+
+// compositeAggregation returns the page of the composite aggregation following
+// after, with one source per group and one for the aggregated field
+func (q *Query) compositeAggregation(after map[string]interface{}) (elastic.Aggregation, error) {
+	metricAggr, err := q.getMetricAggregation()
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []elastic.CompositeAggregationValuesSource{}
+	for _, group := range q.groups {
+		sources = append(sources, elastic.NewCompositeAggregationTermsValuesSource(groupAggregationName(group)).Field(group.Field))
+	}
+	sources = append(sources, elastic.NewCompositeAggregationTermsValuesSource(q.aggregationName).Field(q.fieldName))
+
+	aggr := elastic.NewCompositeAggregation().Sources(sources...).Size(q.size)
+	if after != nil {
+		aggr = aggr.AggregateAfter(after)
+	}
+	if metricAggr != nil {
+		aggr = aggr.SubAggregation(metricAggregationName, metricAggr)
+	}
+	return aggr, nil
+}
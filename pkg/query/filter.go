@@ -0,0 +1,211 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// Filter restricts the documents of a query to the ones matching QueryString
+// and every clause of Must but none of MustNot
+type Filter struct {
+	QueryString string
+	Must        []Clause
+	MustNot     []Clause
+}
+
+// Clause matches documents on Field, only one of Term, Wildcard, Exists or
+// Range should be set
+type Clause struct {
+	Field    string
+	Term     string
+	Wildcard string
+	Exists   bool
+	Range    *Range
+}
+
+// Range bounds the values of a field, unset bounds are ignored
+type Range struct {
+	Gt  string
+	Gte string
+	Lt  string
+	Lte string
+}
+
+// queries returns the elasticsearch queries every document has to match and
+// the ones no document may match
+func (f Filter) queries() ([]elastic.Query, []elastic.Query, error) {
+	must := []elastic.Query{}
+	if f.QueryString != "" {
+		must = append(must, elastic.NewQueryStringQuery(f.QueryString))
+	}
+	for _, clause := range f.Must {
+		query, err := clause.query()
+		if err != nil {
+			return nil, nil, err
+		}
+		must = append(must, query)
+	}
+
+	mustNot := []elastic.Query{}
+	for _, clause := range f.MustNot {
+		query, err := clause.query()
+		if err != nil {
+			return nil, nil, err
+		}
+		mustNot = append(mustNot, query)
+	}
+	return must, mustNot, nil
+}
+
+// Validate checks that every clause has a field and a single condition
+func (f Filter) Validate() error {
+	for _, clause := range append(append([]Clause{}, f.Must...), f.MustNot...) {
+		if err := clause.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Clause) validate() error {
+	if c.Field == "" {
+		return errors.New("clause requires a field")
+	}
+	set := 0
+	for _, isSet := range []bool{c.Term != "", c.Wildcard != "", c.Exists, c.Range != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.Errorf("clause on %s requires exactly one of term, wildcard, exists or range", c.Field)
+	}
+	if c.Range != nil && c.Range.Gt == "" && c.Range.Gte == "" && c.Range.Lt == "" && c.Range.Lte == "" {
+		return errors.Errorf("range on %s requires a bound", c.Field)
+	}
+	return nil
+}
+
+func (c Clause) query() (elastic.Query, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	switch {
+	case c.Term != "":
+		return elastic.NewTermQuery(c.Field, c.Term), nil
+	case c.Wildcard != "":
+		return elastic.NewWildcardQuery(c.Field, c.Wildcard), nil
+	case c.Exists:
+		return elastic.NewExistsQuery(c.Field), nil
+	}
+
+	query := elastic.NewRangeQuery(c.Field)
+	if c.Range.Gt != "" {
+		query = query.Gt(c.Range.Gt)
+	}
+	if c.Range.Gte != "" {
+		query = query.Gte(c.Range.Gte)
+	}
+	if c.Range.Lt != "" {
+		query = query.Lt(c.Range.Lt)
+	}
+	if c.Range.Lte != "" {
+		query = query.Lte(c.Range.Lte)
+	}
+	return query, nil
+}
+
+// logQL returns the LogQL label filters of the filter, appended to the stream
+// selector. Query strings have no LogQL equivalent and ranges must be
+// numeric.
+func (f Filter) logQL() (string, error) {
+	if f.QueryString != "" {
+		return "", errors.New("query strings are not supported by loki")
+	}
+	filters := []string{}
+	for _, clause := range f.Must {
+		filter, err := clause.logQL(false)
+		if err != nil {
+			return "", err
+		}
+		filters = append(filters, " | "+filter)
+	}
+	for _, clause := range f.MustNot {
+		filter, err := clause.logQL(true)
+		if err != nil {
+			return "", err
+		}
+		filters = append(filters, " | "+filter)
+	}
+	return strings.Join(filters, ""), nil
+}
+
+func (c Clause) logQL(negate bool) (string, error) {
+	if err := c.validate(); err != nil {
+		return "", err
+	}
+	equal, match := "=", "=~"
+	if negate {
+		equal, match = "!=", "!~"
+	}
+	switch {
+	case c.Term != "":
+		return fmt.Sprintf("%s%s%s", c.Field, equal, strconv.Quote(c.Term)), nil
+	case c.Wildcard != "":
+		return fmt.Sprintf("%s%s%s", c.Field, match, strconv.Quote(wildcardRegexp(c.Wildcard))), nil
+	case c.Exists && negate:
+		return fmt.Sprintf("%s=\"\"", c.Field), nil
+	case c.Exists:
+		return fmt.Sprintf("%s!=\"\"", c.Field), nil
+	}
+
+	bounds := []struct {
+		value, operator, negated string
+	}{
+		{c.Range.Gt, ">", "<="},
+		{c.Range.Gte, ">=", "<"},
+		{c.Range.Lt, "<", ">="},
+		{c.Range.Lte, "<=", ">"},
+	}
+	comparisons := []string{}
+	for _, bound := range bounds {
+		if bound.value == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(bound.value, 64); err != nil {
+			return "", errors.Errorf("range on %s must be numeric for loki, got %s", c.Field, bound.value)
+		}
+		operator := bound.operator
+		if negate {
+			operator = bound.negated
+		}
+		comparisons = append(comparisons, fmt.Sprintf("%s %s %s", c.Field, operator, bound.value))
+	}
+	// a document is outside of the range when it is outside of any bound
+	if negate {
+		return "(" + strings.Join(comparisons, " or ") + ")", nil
+	}
+	return strings.Join(comparisons, " and "), nil
+}
+
+// wildcardRegexp converts an elasticsearch wildcard pattern to a regular
+// expression, LogQL regular expressions already match whole values
+func wildcardRegexp(pattern string) string {
+	var expr strings.Builder
+	for _, char := range pattern {
+		switch char {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	return expr.String()
+}
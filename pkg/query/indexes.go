@@ -6,14 +6,16 @@ import (
 	"strings"
 	"time"
 
-	elastic "github.com/olivere/elastic/v7"
 	"github.com/pkg/errors"
 )
 
-func LatestIndex(client *elastic.Client, indexPrefix string) (string, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+// LatestIndex returns the last index starting with indexPrefix in
+// alphabetical order, listing the indexes for at most 10 seconds
+func LatestIndex(ctx context.Context, client Backend, indexPrefix string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
-	resp, err := client.CatIndices().Do(ctx)
+	resp, err := client.Indexes(ctx)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to list indexes")
 	}
@@ -21,8 +23,8 @@ func LatestIndex(client *elastic.Client, indexPrefix string) (string, error) {
 	indexes := []string{}
 
 	for _, index := range resp {
-		if strings.HasPrefix(index.Index, indexPrefix) {
-			indexes = append(indexes, index.Index)
+		if strings.HasPrefix(index, indexPrefix) {
+			indexes = append(indexes, index)
 		}
 	}
 
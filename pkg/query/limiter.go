@@ -0,0 +1,92 @@
+package query
+
+import (
+	"context"
+	"sync"
+)
+
+// Limiter bounds the number of queries running at once, across every cluster
+// and for each cluster. A limit of 0 or less is unlimited.
+type Limiter struct {
+	workers       chan struct{}
+	perConnection int
+	// slots of each cluster, by backend type and url
+	connections map[string]chan struct{}
+	lock        *sync.Mutex
+}
+
+// NewLimiter returns a limiter running at most workers queries at once, and at
+// most perConnection of them against the same cluster
+func NewLimiter(workers, perConnection int) *Limiter {
+	limiter := &Limiter{
+		perConnection: perConnection,
+		connections:   map[string]chan struct{}{},
+		lock:          &sync.Mutex{},
+	}
+	if workers > 0 {
+		limiter.workers = make(chan struct{}, workers)
+	}
+	return limiter
+}
+
+// Acquire waits for a slot of the cluster and a worker, and returns the
+// function releasing them. It fails when the context is done first.
+func (l *Limiter) Acquire(ctx context.Context, cluster string) (func(), error) {
+	// the cluster slot is taken first so that queries waiting for a busy
+	// cluster do not hold workers needed by the other clusters
+	connection := l.connection(cluster)
+	if err := acquire(ctx, connection); err != nil {
+		return nil, err
+	}
+	if err := acquire(ctx, l.workers); err != nil {
+		release(connection)
+		return nil, err
+	}
+	return func() {
+		release(l.workers)
+		release(connection)
+	}, nil
+}
+
+func (l *Limiter) connection(cluster string) chan struct{} {
+	if l.perConnection <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	slots, found := l.connections[cluster]
+	if !found {
+		slots = make(chan struct{}, l.perConnection)
+		l.connections[cluster] = slots
+	}
+	return slots
+}
+
+// ClusterKey identifies a cluster for the limiter by its backend type and url,
+// elasticsearch when the type is empty
+func ClusterKey(backendType, url string) string {
+	if backendType == "" {
+		backendType = BackendElasticsearch
+	}
+	return backendType + "/" + url
+}
+
+// acquire takes a slot of slots, nil slots are unlimited
+func acquire(ctx context.Context, slots chan struct{}) error {
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func release(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
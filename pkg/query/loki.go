@@ -0,0 +1,265 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// defaultPercents are the percents of percentiles metrics without percents,
+// the same as the elasticsearch defaults
+var defaultPercents = []float64{1, 5, 25, 50, 75, 95, 99}
+
+// HTTPError is returned for error responses of backends without structured
+// errors
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// seriesQuerier is implemented by backends that compute the series of a query
+// themselves instead of through elasticsearch search requests
+type seriesQuerier interface {
+	querySeries(ctx context.Context, q *Query, index string) ([]Series, error)
+	explain(q *Query, index string) ([]byte, error)
+}
+
+// lokiQueryPath is the path of the instant query API
+const lokiQueryPath = "/loki/api/v1/query"
+
+// lokiBackend runs queries as LogQL instant queries, grouping by the labels
+// of the groups and the aggregated field. The index is the stream selector,
+// which defaults to the streams having every grouped label.
+type lokiBackend struct {
+	url         string
+	credentials Credentials
+	client      *http.Client
+}
+
+func newLokiBackend(url string, credentials Credentials, client *http.Client) *lokiBackend {
+	return &lokiBackend{
+		url:         strings.TrimSuffix(url, "/"),
+		credentials: credentials,
+		client:      client,
+	}
+}
+
+func (b *lokiBackend) Search(ctx context.Context, index string, source *elastic.SearchSource) (*elastic.SearchResult, error) {
+	return nil, errors.New("loki does not support search requests")
+}
+
+// Indexes returns the stream labels, as loki has no indexes
+func (b *lokiBackend) Indexes(ctx context.Context) ([]string, error) {
+	response := struct {
+		Data []string `json:"data"`
+	}{}
+	if err := b.get(ctx, "/loki/api/v1/labels", url.Values{}, &response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+func (b *lokiBackend) Version(ctx context.Context) (string, error) {
+	response := struct {
+		Version string `json:"version"`
+	}{}
+	if err := b.get(ctx, "/loki/api/v1/status/buildinfo", url.Values{}, &response); err != nil {
+		return "", err
+	}
+	return response.Version, nil
+}
+
+func (b *lokiBackend) querySeries(ctx context.Context, q *Query, index string) ([]Series, error) {
+	queries, err := b.logQL(q, index)
+	if err != nil {
+		return nil, err
+	}
+
+	at := time.Now().Add(-q.offset)
+	series := []Series{}
+	for quantile, logQL := range queries {
+		params := url.Values{}
+		params.Set("query", logQL)
+		params.Set("time", strconv.FormatInt(at.UnixNano(), 10))
+
+		response := lokiResponse{}
+		q.searches++
+		if err := b.get(ctx, lokiQueryPath, params, &response); err != nil {
+			return nil, err
+		}
+		if response.Data.ResultType != "vector" {
+			return nil, errors.Errorf("unexpected %s result of query %s", response.Data.ResultType, logQL)
+		}
+
+		for _, sample := range response.Data.Result {
+			labels := map[string]string{}
+			for _, group := range q.groups {
+				labels[group.Label] = sample.Metric[group.Field]
+			}
+			value, err := sample.value()
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value of query %s", logQL)
+			}
+			series = append(series, Series{
+				Labels: labels,
+				Key:    sample.Metric[q.fieldName],
+				Values: []Value{{Quantile: quantile, Value: value}},
+			})
+		}
+	}
+	return series, nil
+}
+
+// explain returns the instant query requests of q, each preceded by its LogQL
+// as a comment
+func (b *lokiBackend) explain(q *Query, index string) ([]byte, error) {
+	queries, err := b.logQL(q, index)
+	if err != nil {
+		return nil, err
+	}
+	logQLs := []string{}
+	for _, logQL := range queries {
+		logQLs = append(logQLs, logQL)
+	}
+	sort.Strings(logQLs)
+
+	lines := []string{}
+	for _, logQL := range logQLs {
+		params := url.Values{}
+		params.Set("query", logQL)
+		lines = append(lines, "# "+logQL, http.MethodGet+" "+lokiQueryPath+"?"+params.Encode())
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// logQL returns the LogQL queries of q keyed by quantile, percentiles metrics
+// need one query per percent and other metrics have a single query with an
+// empty quantile
+func (b *lokiBackend) logQL(q *Query, index string) (map[string]string, error) {
+	labels := []string{}
+	for _, group := range q.groups {
+		labels = append(labels, group.Field)
+	}
+	labels = append(labels, q.fieldName)
+
+	selector := index
+	if selector == "" {
+		matchers := []string{}
+		for _, label := range labels {
+			matchers = append(matchers, fmt.Sprintf("%s=~\".+\"", label))
+		}
+		selector = "{" + strings.Join(matchers, ",") + "}"
+	}
+	filters, err := q.filter.logQL()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid filter")
+	}
+	selector += filters
+	by := "by (" + strings.Join(labels, ", ") + ")"
+	window := "[" + logQLDuration(q.interval) + "]"
+	unwrapped := fmt.Sprintf("%s | unwrap %s %s", selector, q.metric.Field, window)
+
+	if q.metric.Type != MetricCount && q.metric.Field == "" {
+		return nil, errors.Errorf("metric %s requires a field", q.metric.Type)
+	}
+	switch q.metric.Type {
+	case MetricCount:
+		return map[string]string{"": fmt.Sprintf("sum %s (count_over_time(%s %s))", by, selector, window)}, nil
+	case MetricAvg:
+		// grouped like quantiles, averaging every line of the group instead of
+		// the averages of its streams
+		return map[string]string{"": fmt.Sprintf("avg_over_time(%s) %s", unwrapped, by)}, nil
+	case MetricSum, MetricMin, MetricMax:
+		return map[string]string{"": fmt.Sprintf("%s %s (%s_over_time(%s))", q.metric.Type, by, q.metric.Type, unwrapped)}, nil
+	case MetricPercentiles:
+		percents := q.metric.Percents
+		if len(percents) == 0 {
+			percents = defaultPercents
+		}
+		queries := map[string]string{}
+		for _, percent := range percents {
+			label := quantile(percent)
+			queries[label] = fmt.Sprintf("quantile_over_time(%s, %s) %s", label, unwrapped, by)
+		}
+		return queries, nil
+	}
+	return nil, errors.Errorf("metric %s is not supported by loki", q.metric.Type)
+}
+
+// logQLDuration formats d as a LogQL duration, in seconds unless it has a
+// fraction of a second
+func logQLDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+type lokiResponse struct {
+	Data struct {
+		ResultType string       `json:"resultType"`
+		Result     []lokiSample `json:"result"`
+	} `json:"data"`
+}
+
+type lokiSample struct {
+	Metric map[string]string `json:"metric"`
+	// Value is a timestamp and a value formatted as a string
+	Value []interface{} `json:"value"`
+}
+
+func (s lokiSample) value() (float64, error) {
+	if len(s.Value) != 2 {
+		return 0, errors.Errorf("expected a timestamp and a value, got %v", s.Value)
+	}
+	value, ok := s.Value[1].(string)
+	if !ok {
+		return 0, errors.Errorf("expected a string value, got %v", s.Value[1])
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func (b *lokiBackend) get(ctx context.Context, path string, params url.Values, result interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, b.url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req = req.WithContext(ctx)
+	if b.credentials.Username != "" || b.credentials.Password != "" {
+		req.SetBasicAuth(b.credentials.Username, b.credentials.Password)
+	}
+	if authorization := b.credentials.authorization(); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HTTPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return errors.Wrap(err, "failed to decode response")
+	}
+	return nil
+}
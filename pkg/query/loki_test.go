@@ -0,0 +1,259 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLokiBackend(t *testing.T, url string, credentials Credentials) Backend {
+	t.Helper()
+	backend, err := NewBackend(BackendLoki, url, credentials, TLS{}, Timeouts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestLokiLogQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		index    string
+		query    func(q *Query) *Query
+		expected map[string]string
+		err      string
+	}{
+		{
+			name:     "count with the default selector",
+			query:    func(q *Query) *Query { return q.WithGroups(Group{Label: "ns", Field: "namespace"}) },
+			expected: map[string]string{"": `sum by (namespace, pod) (count_over_time({namespace=~".+",pod=~".+"} [300s]))`},
+		},
+		{
+			name:     "count with a selector",
+			index:    `{job="kubernetes-pods"}`,
+			query:    func(q *Query) *Query { return q },
+			expected: map[string]string{"": `sum by (pod) (count_over_time({job="kubernetes-pods"} [300s]))`},
+		},
+		{
+			name:     "sum of an unwrapped label",
+			index:    `{job="nginx"}`,
+			query:    func(q *Query) *Query { return q.WithMetric(Metric{Type: MetricSum, Field: "bytes"}) },
+			expected: map[string]string{"": `sum by (pod) (sum_over_time({job="nginx"} | unwrap bytes [300s]))`},
+		},
+		{
+			name:     "avg of every line of the group",
+			index:    `{job="nginx"}`,
+			query:    func(q *Query) *Query { return q.WithMetric(Metric{Type: MetricAvg, Field: "bytes"}) },
+			expected: map[string]string{"": `avg_over_time({job="nginx"} | unwrap bytes [300s]) by (pod)`},
+		},
+		{
+			name:  "percentiles",
+			index: `{job="nginx"}`,
+			query: func(q *Query) *Query {
+				return q.WithMetric(Metric{Type: MetricPercentiles, Field: "duration", Percents: []float64{50, 99, 99.9}})
+			},
+			expected: map[string]string{
+				"0.5":   `quantile_over_time(0.5, {job="nginx"} | unwrap duration [300s]) by (pod)`,
+				"0.99":  `quantile_over_time(0.99, {job="nginx"} | unwrap duration [300s]) by (pod)`,
+				"0.999": `quantile_over_time(0.999, {job="nginx"} | unwrap duration [300s]) by (pod)`,
+			},
+		},
+		{
+			name:  "label filters",
+			index: `{job="nginx"}`,
+			query: func(q *Query) *Query {
+				return q.WithFilter(Filter{
+					Must:    []Clause{{Field: "level", Term: "error"}, {Field: "path", Wildcard: "/api/*"}},
+					MustNot: []Clause{{Field: "status", Range: &Range{Gte: "500", Lt: "600"}}},
+				})
+			},
+			expected: map[string]string{"": `sum by (pod) (count_over_time({job="nginx"} | level="error" | path=~"/api/.*" | (status < 500 or status >= 600) [300s]))`},
+		},
+		{
+			name:  "query string",
+			query: func(q *Query) *Query { return q.WithFilter(Filter{QueryString: "level:error"}) },
+			err:   "query strings are not supported by loki",
+		},
+		{
+			name:  "cardinality",
+			query: func(q *Query) *Query { return q.WithMetric(Metric{Type: MetricCardinality, Field: "user"}) },
+			err:   "metric cardinality is not supported by loki",
+		},
+	}
+
+	backend := &lokiBackend{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := test.query(NewQuery(backend, "pod", 5*time.Minute))
+			queries, err := backend.logQL(q, test.index)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queries) != len(test.expected) {
+				t.Fatalf("expected queries %v, got %v", test.expected, queries)
+			}
+			for quantile, logQL := range test.expected {
+				if queries[quantile] != logQL {
+					t.Errorf("expected query\n%s\ngot\n%s", logQL, queries[quantile])
+				}
+			}
+		})
+	}
+}
+
+func TestLokiQuery(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.URL.Path != lokiQueryPath {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"status": "success",
+			"data": {
+				"resultType": "vector",
+				"result": [
+					{"metric": {"namespace": "default", "pod": "api-1"}, "value": [1700000000, "42"]},
+					{"metric": {"namespace": "monitoring", "pod": "prometheus-0"}, "value": [1700000000, "7"]}
+				]
+			}
+		}`)
+	}))
+	defer server.Close()
+	backend := newTestLokiBackend(t, server.URL, Credentials{Username: "tenant", Password: "secret"})
+
+	q := NewQuery(backend, "pod", 5*time.Minute).
+		WithWindow("", time.Minute).
+		WithGroups(Group{Label: "ns", Field: "namespace"})
+	before := time.Now().Add(-time.Minute)
+	series, err := q.Query(context.Background(), `{job="kubernetes-pods"}`, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("expected a single request, got %d", len(requests))
+	}
+	params := requests[0].URL.Query()
+	if expected := `sum by (namespace, pod) (count_over_time({job="kubernetes-pods"} [300s]))`; params.Get("query") != expected {
+		t.Errorf("expected query %s, got %s", expected, params.Get("query"))
+	}
+	nanos, err := strconv.ParseInt(params.Get("time"), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid time %s: %v", params.Get("time"), err)
+	}
+	if queried := time.Unix(0, nanos); queried.Before(before) || queried.After(time.Now().Add(-time.Minute)) {
+		t.Errorf("expected the query time to be moved back by the offset, got %s", queried)
+	}
+	if username, password, ok := requests[0].BasicAuth(); !ok || username != "tenant" || password != "secret" {
+		t.Errorf("expected basic auth as tenant, got %s:%s", username, password)
+	}
+	if q.Searches() != 1 {
+		t.Errorf("expected 1 search, got %d", q.Searches())
+	}
+
+	expected := []Series{
+		{Labels: map[string]string{"ns": "default"}, Key: "api-1", Values: []Value{{Value: 42}}},
+		{Labels: map[string]string{"ns": "monitoring"}, Key: "prometheus-0", Values: []Value{{Value: 7}}},
+	}
+	assertSeries(t, expected, series)
+}
+
+func TestLokiQueryPercentiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := "0.1"
+		if strings.HasPrefix(r.URL.Query().Get("query"), "quantile_over_time(0.99,") {
+			value = "2.5"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"pod":"api-1"},"value":[1700000000,"%s"]}]}}`, value)
+	}))
+	defer server.Close()
+	backend := newTestLokiBackend(t, server.URL, Credentials{})
+
+	q := NewQuery(backend, "pod", 5*time.Minute).
+		WithMetric(Metric{Type: MetricPercentiles, Field: "duration", Percents: []float64{50, 99}})
+	series, err := q.Query(context.Background(), `{job="nginx"}`, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Series{
+		{Labels: map[string]string{}, Key: "api-1", Values: []Value{{Quantile: "0.5", Value: 0.1}}},
+		{Labels: map[string]string{}, Key: "api-1", Values: []Value{{Quantile: "0.99", Value: 2.5}}},
+	}
+	assertSeries(t, expected, series)
+	if q.Searches() != 2 {
+		t.Errorf("expected a search per percent, got %d", q.Searches())
+	}
+}
+
+func TestLokiErrorResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		err    string
+	}{
+		{
+			name:   "bad request",
+			status: http.StatusBadRequest,
+			body:   "parse error at line 1, col 5: syntax error: unexpected IDENTIFIER\n",
+			err:    "400 Bad Request: parse error at line 1, col 5: syntax error: unexpected IDENTIFIER",
+		},
+		{
+			name:   "matrix result",
+			status: http.StatusOK,
+			body:   `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+			err:    "unexpected matrix result",
+		},
+		{
+			name:   "invalid value",
+			status: http.StatusOK,
+			body:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"pod":"api-1"},"value":[1700000000]}]}}`,
+			err:    "expected a timestamp and a value",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+			backend := newTestLokiBackend(t, server.URL, Credentials{})
+
+			_, err := NewQuery(backend, "pod", 5*time.Minute).Query(context.Background(), `{job="nginx"}`, map[string]string{})
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestLokiExplain(t *testing.T) {
+	backend := newTestLokiBackend(t, "http://loki:3100", Credentials{})
+
+	body, err := NewQuery(backend, "pod", 5*time.Minute).Explain(`{job="nginx"}`, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# sum by (pod) (count_over_time({job="nginx"} [300s]))
+GET /loki/api/v1/query?query=sum+by+%28pod%29+%28count_over_time%28%7Bjob%3D%22nginx%22%7D+%5B300s%5D%29%29`
+	if string(body) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, body)
+	}
+}
@@ -0,0 +1,116 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// openSearchBackend sends requests over plain HTTP rather than through the
+// elastic client, whose version checks and response handling do not support
+// every OpenSearch release. Responses of the search API are compatible.
+type openSearchBackend struct {
+	url         string
+	credentials Credentials
+	client      *http.Client
+}
+
+func newOpenSearchBackend(url string, credentials Credentials, client *http.Client) *openSearchBackend {
+	return &openSearchBackend{
+		url:         strings.TrimSuffix(url, "/"),
+		credentials: credentials,
+		client:      client,
+	}
+}
+
+func (b *openSearchBackend) Search(ctx context.Context, index string, source *elastic.SearchSource) (*elastic.SearchResult, error) {
+	body, err := source.Source()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build search request")
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode search request")
+	}
+
+	result := &elastic.SearchResult{}
+	if err := b.do(ctx, http.MethodPost, "/"+url.PathEscape(index)+"/_search", bytes.NewReader(data), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (b *openSearchBackend) Indexes(ctx context.Context) ([]string, error) {
+	rows := []struct {
+		Index string `json:"index"`
+	}{}
+	if err := b.do(ctx, http.MethodGet, "/_cat/indices?format=json&h=index", nil, &rows); err != nil {
+		return nil, err
+	}
+	indexes := []string{}
+	for _, row := range rows {
+		indexes = append(indexes, row.Index)
+	}
+	return indexes, nil
+}
+
+func (b *openSearchBackend) Version(ctx context.Context) (string, error) {
+	info := struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}{}
+	if err := b.do(ctx, http.MethodGet, "/", nil, &info); err != nil {
+		return "", err
+	}
+	return info.Version.Number, nil
+}
+
+// do sends the request and decodes the response into result, error responses
+// are returned as *elastic.Error like the elastic client does
+func (b *openSearchBackend) do(ctx context.Context, method, path string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, b.url+path, body)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if b.credentials.Username != "" || b.credentials.Password != "" {
+		req.SetBasicAuth(b.credentials.Username, b.credentials.Password)
+	}
+	if authorization := b.credentials.authorization(); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// the body of errors returned by proxies may not be JSON, in which
+		// case only the status is known
+		elasticErr := &elastic.Error{}
+		_ = json.Unmarshal(data, elasticErr)
+		elasticErr.Status = resp.StatusCode
+		return elasticErr
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return errors.Wrap(err, "failed to decode response")
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	elastic "github.com/olivere/elastic/v7"
+)
+
+// fixtureServer answers requests to each method and path with the recorded
+// response in testdata/opensearch, recording the requests it received
+type fixtureServer struct {
+	*httptest.Server
+	requests []*http.Request
+	bodies   []map[string]interface{}
+}
+
+type fixture struct {
+	status int
+	file   string
+}
+
+func newFixtureServer(t *testing.T, fixtures map[string]fixture) *fixtureServer {
+	t.Helper()
+	server := &fixtureServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		if data, _ := ioutil.ReadAll(r.Body); len(data) > 0 {
+			if err := json.Unmarshal(data, &body); err != nil {
+				t.Errorf("invalid request body %s: %v", data, err)
+			}
+		}
+		server.requests = append(server.requests, r)
+		server.bodies = append(server.bodies, body)
+
+		f, found := fixtures[r.Method+" "+r.URL.Path]
+		if !found {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "opensearch", f.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if f.status != 0 {
+			w.WriteHeader(f.status)
+		}
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestOpenSearchBackend(t *testing.T, url string, credentials Credentials) Backend {
+	t.Helper()
+	backend, err := NewBackend(BackendOpenSearch, url, credentials, TLS{}, Timeouts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestOpenSearchVersion(t *testing.T) {
+	server := newFixtureServer(t, map[string]fixture{"GET /": {file: "info.json"}})
+	backend := newTestOpenSearchBackend(t, server.URL, Credentials{})
+
+	version, err := backend.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "2.11.1" {
+		t.Errorf("expected version 2.11.1, got %s", version)
+	}
+}
+
+func TestOpenSearchLatestIndex(t *testing.T) {
+	server := newFixtureServer(t, map[string]fixture{"GET /_cat/indices": {file: "indices.json"}})
+	backend := newTestOpenSearchBackend(t, server.URL, Credentials{})
+
+	index, err := LatestIndex(context.Background(), backend, "logs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != "logs-2024.01.03" {
+		t.Errorf("expected index logs-2024.01.03, got %s", index)
+	}
+	if query := server.requests[0].URL.Query(); query.Get("format") != "json" {
+		t.Errorf("expected a JSON listing of the indexes, got query %s", query.Encode())
+	}
+}
+
+func TestOpenSearchQueryGroups(t *testing.T) {
+	server := newFixtureServer(t, map[string]fixture{"POST /logs-*/_search": {file: "search_groups.json"}})
+	backend := newTestOpenSearchBackend(t, server.URL, Credentials{Username: "exporter", Password: "secret"})
+
+	q := NewQuery(backend, "kubernetes.container.name", 5*time.Minute).
+		WithGroups(Group{Label: "namespace", Field: "kubernetes.namespace"})
+	series, err := q.Query(context.Background(), "logs-*", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	username, password, ok := server.requests[0].BasicAuth()
+	if !ok || username != "exporter" || password != "secret" {
+		t.Errorf("expected basic auth as exporter, got %s:%s", username, password)
+	}
+	if size, ok := server.bodies[0]["size"].(float64); !ok || size != 0 {
+		t.Errorf("expected a search request without hits, got %v", server.bodies[0])
+	}
+
+	expected := []Series{
+		{Labels: map[string]string{"namespace": "default"}, Key: "api", Values: []Value{{Value: 100}}},
+		{Labels: map[string]string{"namespace": "default"}, Key: "worker", Values: []Value{{Value: 20}}},
+		{Labels: map[string]string{"namespace": "monitoring"}, Key: "prometheus", Values: []Value{{Value: 5}}},
+		{Labels: map[string]string{"namespace": "monitoring"}, Values: []Value{{Value: 2}}, Other: true},
+	}
+	assertSeries(t, expected, series)
+}
+
+func TestOpenSearchQueryPercentiles(t *testing.T) {
+	server := newFixtureServer(t, map[string]fixture{"POST /logs/_search": {file: "search_percentiles.json"}})
+	backend := newTestOpenSearchBackend(t, server.URL, Credentials{})
+
+	q := NewQuery(backend, "service", 5*time.Minute).
+		WithMetric(Metric{Type: MetricPercentiles, Field: "duration", Percents: []float64{50, 99, 99.9}})
+	series, err := q.Query(context.Background(), "logs", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("expected a single series, got %v", series)
+	}
+	values := series[0].Values
+	sort.Slice(values, func(i, j int) bool { return values[i].Quantile < values[j].Quantile })
+	expected := []Value{{Quantile: "0.5", Value: 0.125}, {Quantile: "0.99", Value: 1.5}, {Quantile: "0.999", Value: 2.75}}
+	if len(values) != len(expected) {
+		t.Fatalf("expected values %v, got %v", expected, values)
+	}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("expected values %v, got %v", expected, values)
+		}
+	}
+}
+
+func TestOpenSearchErrorResponse(t *testing.T) {
+	server := newFixtureServer(t, map[string]fixture{"POST /logs/_search": {status: http.StatusForbidden, file: "error_forbidden.json"}})
+	backend := newTestOpenSearchBackend(t, server.URL, Credentials{})
+
+	_, err := backend.Search(context.Background(), "logs", elastic.NewSearchSource())
+	elasticErr, ok := err.(*elastic.Error)
+	if !ok {
+		t.Fatalf("expected an elastic error, got %v", err)
+	}
+	if elasticErr.Status != http.StatusForbidden || elasticErr.Details == nil || elasticErr.Details.Type != "security_exception" {
+		t.Errorf("expected a 403 security_exception, got %v", elasticErr)
+	}
+}
+
+func TestOpenSearchErrorResponseWithoutJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("<html>502 Bad Gateway</html>"))
+	}))
+	defer server.Close()
+	backend := newTestOpenSearchBackend(t, server.URL, Credentials{})
+
+	_, err := backend.Version(context.Background())
+	elasticErr, ok := err.(*elastic.Error)
+	if !ok || elasticErr.Status != http.StatusBadGateway {
+		t.Errorf("expected a 502 elastic error, got %v", err)
+	}
+}
+
+// assertSeries compares series regardless of their order
+func assertSeries(t *testing.T, expected, actual []Series) {
+	t.Helper()
+	key := func(s Series) string {
+		data, _ := json.Marshal(s)
+		return string(data)
+	}
+	sortSeries := func(series []Series) []string {
+		keys := []string{}
+		for _, s := range series {
+			keys = append(keys, key(s))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	expectedKeys, actualKeys := sortSeries(expected), sortSeries(actual)
+	if len(expectedKeys) != len(actualKeys) {
+		t.Fatalf("expected series\n%v\ngot\n%v", expectedKeys, actualKeys)
+	}
+	for i := range expectedKeys {
+		if expectedKeys[i] != actualKeys[i] {
+			t.Errorf("expected series\n%v\ngot\n%v", expectedKeys, actualKeys)
+			return
+		}
+	}
+}
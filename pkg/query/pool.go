@@ -0,0 +1,81 @@
+package query
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ClientPool shares backends, and their connections, between the owners using
+// the same backend type, endpoint, credentials, TLS options and timeouts
+type ClientPool struct {
+	clients map[string]*pooledClient
+	// key of the client used by each owner
+	owners map[string]string
+	lock   *sync.Mutex
+}
+
+type pooledClient struct {
+	backend   Backend
+	transport *http.Transport
+}
+
+func NewClientPool() *ClientPool {
+	return &ClientPool{
+		clients: map[string]*pooledClient{},
+		owners:  map[string]string{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Get returns the backend for the endpoint, credentials, TLS options and
+// timeouts, creating it on first use. The backend previously used by owner is
+// released when they changed, e.g. after a secret rotation.
+func (p *ClientPool) Get(owner, backendType, url string, credentials Credentials, tlsOptions TLS, timeouts Timeouts) (Backend, error) {
+	key := ClientKey(backendType, url, credentials, tlsOptions, timeouts)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pooled, found := p.clients[key]
+	if !found {
+		backend, transport, err := newBackend(backendType, url, credentials, tlsOptions, timeouts)
+		if err != nil {
+			return nil, err
+		}
+		pooled = &pooledClient{backend: backend, transport: transport}
+		p.clients[key] = pooled
+	}
+
+	previous, found := p.owners[owner]
+	p.owners[owner] = key
+	if found && previous != key {
+		p.release(previous)
+	}
+	return pooled.backend, nil
+}
+
+// Release stops owner from using its client, which is closed once no other
+// owner uses it
+func (p *ClientPool) Release(owner string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	key, found := p.owners[owner]
+	if !found {
+		return
+	}
+	delete(p.owners, owner)
+	p.release(key)
+}
+
+func (p *ClientPool) release(key string) {
+	for _, used := range p.owners {
+		if used == key {
+			return
+		}
+	}
+	if pooled, found := p.clients[key]; found {
+		pooled.transport.CloseIdleConnections()
+		delete(p.clients, key)
+	}
+}
@@ -3,34 +3,182 @@ package query
 import (
 	"context"
 	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 
 	elastic "github.com/olivere/elastic/v7"
 	"github.com/pkg/errors"
 )
 
+// Metric types computed for every terms bucket
+const (
+	MetricCount       = "count"
+	MetricSum         = "sum"
+	MetricAvg         = "avg"
+	MetricMin         = "min"
+	MetricMax         = "max"
+	MetricPercentiles = "percentiles"
+	MetricCardinality = "cardinality"
+)
+
+const metricAggregationName = "metric"
+
+// DefaultSize is the default number of buckets of terms aggregations
+const DefaultSize = 100
+
+// DefaultTimeField is the default date field of the query window
+const DefaultTimeField = "@timestamp"
+
 type Query struct {
-	client          *elastic.Client
+	client          Backend
 	fieldName       string
 	interval        time.Duration
+	timeField       string
+	offset          time.Duration
 	aggregationName string
+	metric          Metric
+	groups          []Group
+	size            int
+	paginate        bool
+	filter          Filter
+	limiter         *Limiter
+	cluster         string
+	// number of search requests sent
+	searches int
 }
 
-type QueryResult map[string]int64
+// Metric is computed on Field for every terms bucket, the count metric uses
+// the number of documents of the bucket instead
+type Metric struct {
+	Type     string
+	Field    string
+	Percents []float64
+}
+
+// Value is the metric value of a bucket, Quantile is only set for percentiles
+type Value struct {
+	Quantile string
+	Value    float64
+}
+
+// quantile returns the quantile of percent, shifting its decimal point in the
+// decimal representation as dividing by 100 is not exact, e.g. 99.9 / 100 is
+// 0.9990000000000001
+func quantile(percent float64) string {
+	integer, fraction := strconv.FormatFloat(percent, 'f', -1, 64), ""
+	if i := strings.IndexByte(integer, '.'); i >= 0 {
+		integer, fraction = integer[:i], integer[i+1:]
+	}
+	digits, point := integer+fraction, len(integer)-2
+	if point <= 0 {
+		integer, fraction = "0", strings.Repeat("0", -point)+digits
+	} else {
+		integer, fraction = digits[:point], digits[point:]
+	}
+	if fraction = strings.TrimRight(fraction, "0"); fraction == "" {
+		return integer
+	}
+	return integer + "." + fraction
+}
 
-func NewQuery(client *elastic.Client, fieldName string, interval time.Duration) *Query {
+func NewQuery(client Backend, fieldName string, interval time.Duration) *Query {
 	query := &Query{
 		client:          client,
 		fieldName:       fieldName,
 		interval:        interval,
+		timeField:       DefaultTimeField,
 		aggregationName: "documents",
+		metric:          Metric{Type: MetricCount},
+		size:            DefaultSize,
 	}
 
 	return query
 }
 
-func (q *Query) Query(ctx context.Context, indexName string, fields map[string]string) (QueryResult, error) {
-	query := q.getQuery(fields)
+// WithWindow sets the date field of the query window and moves the end of
+// the window back by offset
+func (q *Query) WithWindow(timeField string, offset time.Duration) *Query {
+	if timeField != "" {
+		q.timeField = timeField
+	}
+	q.offset = offset
+	return q
+}
+
+// WithSize sets the maximum number of buckets of every terms aggregation, or
+// the page size when paginating
+func (q *Query) WithSize(size int) *Query {
+	if size > 0 {
+		q.size = size
+	}
+	return q
+}
+
+// WithPagination pages through every combination of buckets with a composite
+// aggregation instead of truncating terms aggregations
+func (q *Query) WithPagination(paginate bool) *Query {
+	q.paginate = paginate
+	return q
+}
+
+// WithMetric sets the metric computed for every bucket, defaults to count
+func (q *Query) WithMetric(metric Metric) *Query {
+	if metric.Type == "" {
+		metric.Type = MetricCount
+	}
+	q.metric = metric
+	return q
+}
+
+// WithGroups nests the aggregation of the field under one terms aggregation
+// per group, producing a series for every combination found in the index
+func (q *Query) WithGroups(groups ...Group) *Query {
+	q.groups = groups
+	return q
+}
+
+// WithFilter restricts the documents aggregated by the query
+func (q *Query) WithFilter(filter Filter) *Query {
+	q.filter = filter
+	return q
+}
+
+// WithLimiter runs the query once limiter grants it a slot of cluster, the
+// ClusterKey of the backend type and url of the client
+func (q *Query) WithLimiter(limiter *Limiter, cluster string) *Query {
+	q.limiter = limiter
+	q.cluster = cluster
+	return q
+}
+
+// Searches returns the number of search requests sent by the query, more than
+// one when paginated
+func (q *Query) Searches() int {
+	return q.searches
+}
+
+func (q *Query) Query(ctx context.Context, indexName string, fields map[string]string) ([]Series, error) {
+	if q.limiter != nil {
+		release, err := q.limiter.Acquire(ctx, q.cluster)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to wait for a query slot")
+		}
+		defer release()
+	}
+
+	if querier, ok := q.client.(seriesQuerier); ok {
+		return querier.querySeries(ctx, q, indexName)
+	}
+
+	query, err := q.getQuery(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.paginate {
+		return q.queryComposite(ctx, indexName, query)
+	}
 
 	result, err := q.getResult(ctx, indexName, query)
 	if err != nil {
@@ -40,8 +188,8 @@ func (q *Query) Query(ctx context.Context, indexName string, fields map[string]s
 	return q.decodeResult(result)
 }
 
-func (q *Query) getQuery(fields map[string]string) elastic.Query {
-	now := time.Now()
+func (q *Query) getQuery(fields map[string]string) (elastic.Query, error) {
+	now := time.Now().Add(-q.offset)
 	formatForES := "2006-01-02T15:04:05-07:00"
 	nowStr := now.Format(formatForES)
 	ltStr := nowStr
@@ -50,7 +198,7 @@ func (q *Query) getQuery(fields map[string]string) elastic.Query {
 	gtStr := gt.Format(formatForES)
 
 	queries := []elastic.Query{
-		elastic.NewRangeQuery("@timestamp").
+		elastic.NewRangeQuery(q.timeField).
 			Gt(gtStr).
 			Lt(ltStr),
 	}
@@ -59,40 +207,153 @@ func (q *Query) getQuery(fields map[string]string) elastic.Query {
 		queries = append(queries, elastic.NewTermQuery(k, v))
 	}
 
+	must, mustNot, err := q.filter.queries()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid filter")
+	}
+	queries = append(queries, must...)
+
 	boolQuery := elastic.NewBoolQuery()
 	boolQuery.Must(queries...)
+	if len(mustNot) > 0 {
+		boolQuery.MustNot(mustNot...)
+	}
+
+	return boolQuery, nil
+}
+
+// Explain returns the body of the search request of the query, or of its
+// first page when paginated, as sent to elasticsearch. Backends without
+// search requests return their own queries.
+func (q *Query) Explain(indexName string, fields map[string]string) ([]byte, error) {
+	if querier, ok := q.client.(seriesQuerier); ok {
+		return querier.explain(q, indexName)
+	}
+
+	query, err := q.getQuery(fields)
+	if err != nil {
+		return nil, err
+	}
+	source, err := q.searchSource(query, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := source.Source()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build search request")
+	}
+	data, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode search request")
+	}
+	return data, nil
+}
 
-	return boolQuery
+// searchSource returns the search request of the query, after is the
+// after_key of the previous page of a paginated query
+func (q *Query) searchSource(query elastic.Query, after map[string]interface{}) (*elastic.SearchSource, error) {
+	source := elastic.NewSearchSource().Query(query).Size(0)
+	if q.paginate {
+		aggr, err := q.compositeAggregation(after)
+		if err != nil {
+			return nil, err
+		}
+		return source.Aggregation(q.aggregationName, aggr), nil
+	}
+
+	aggr := elastic.NewTermsAggregation().Field(q.fieldName).Size(q.size)
+	metricAggr, err := q.getMetricAggregation()
+	if err != nil {
+		return nil, err
+	}
+	if metricAggr != nil {
+		aggr = aggr.SubAggregation(metricAggregationName, metricAggr)
+	}
+	name, nested := q.nestAggregation(aggr)
+	return source.Aggregation(name, nested), nil
 }
 
 func (q *Query) getResult(ctx context.Context, indexName string, query elastic.Query) (*elastic.SearchResult, error) {
-	aggr := elastic.NewTermsAggregation().Field(q.fieldName).Size(100)
-	return q.client.Search().
-		Index(indexName).
-		Query(query).
-		Size(0).
-		Aggregation(q.aggregationName, aggr).
-		Pretty(true).
-		Do(context.Background())
-}
-
-func (q *Query) decodeResult(result *elastic.SearchResult) (QueryResult, error) {
-	rawMsg := result.Aggregations[q.aggregationName]
-	var ar elastic.AggregationBucketKeyItems
-	err := json.Unmarshal(rawMsg, &ar)
+	source, err := q.searchSource(query, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to unmarshal result")
+		return nil, err
 	}
+	q.searches++
+	return q.client.Search(ctx, indexName, source)
+}
 
-	qr := QueryResult{}
+func (q *Query) decodeResult(result *elastic.SearchResult) ([]Series, error) {
+	return q.decodeGroups(result.Aggregations, 0, map[string]string{})
+}
 
-	for _, item := range ar.Buckets {
-		keyStr, ok := item.Key.(string)
-		if !ok {
-			return nil, errors.Errorf("failed to convert key %v to string", item.Key)
+func (q *Query) getMetricAggregation() (elastic.Aggregation, error) {
+	if q.metric.Type != MetricCount && q.metric.Field == "" {
+		return nil, errors.Errorf("metric %s requires a field", q.metric.Type)
+	}
+
+	switch q.metric.Type {
+	case MetricCount:
+		return nil, nil
+	case MetricSum:
+		return elastic.NewSumAggregation().Field(q.metric.Field), nil
+	case MetricAvg:
+		return elastic.NewAvgAggregation().Field(q.metric.Field), nil
+	case MetricMin:
+		return elastic.NewMinAggregation().Field(q.metric.Field), nil
+	case MetricMax:
+		return elastic.NewMaxAggregation().Field(q.metric.Field), nil
+	case MetricCardinality:
+		return elastic.NewCardinalityAggregation().Field(q.metric.Field), nil
+	case MetricPercentiles:
+		aggr := elastic.NewPercentilesAggregation().Field(q.metric.Field)
+		if len(q.metric.Percents) > 0 {
+			aggr = aggr.Percentiles(q.metric.Percents...)
 		}
-		qr[keyStr] = item.DocCount
+		return aggr, nil
 	}
+	return nil, errors.Errorf("unsupported metric type %s", q.metric.Type)
+}
+
+// decodeMetric decodes the metric sub aggregation of a bucket
+func (q *Query) decodeMetric(aggs elastic.Aggregations, docCount int64) ([]Value, error) {
+	var metric *elastic.AggregationValueMetric
+	var found bool
 
-	return qr, nil
+	switch q.metric.Type {
+	case MetricCount:
+		return []Value{{Value: float64(docCount)}}, nil
+	case MetricSum:
+		metric, found = aggs.Sum(metricAggregationName)
+	case MetricAvg:
+		metric, found = aggs.Avg(metricAggregationName)
+	case MetricMin:
+		metric, found = aggs.Min(metricAggregationName)
+	case MetricMax:
+		metric, found = aggs.Max(metricAggregationName)
+	case MetricCardinality:
+		metric, found = aggs.Cardinality(metricAggregationName)
+	case MetricPercentiles:
+		percentiles, found := aggs.Percentiles(metricAggregationName)
+		if !found {
+			return nil, errors.New("percentiles aggregation not found")
+		}
+		values := []Value{}
+		for percent, value := range percentiles.Values {
+			parsed, err := strconv.ParseFloat(percent, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid percentile %s", percent)
+			}
+			values = append(values, Value{Quantile: quantile(parsed), Value: value})
+		}
+		return values, nil
+	}
+
+	if !found {
+		return nil, errors.Errorf("%s aggregation not found", q.metric.Type)
+	}
+	// min, max and avg have no value for buckets without the field
+	if metric.Value == nil {
+		return []Value{}, nil
+	}
+	return []Value{{Value: *metric.Value}}, nil
 }
@@ -0,0 +1,69 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuantile(t *testing.T) {
+	tests := map[float64]string{
+		0.1:   "0.001",
+		1:     "0.01",
+		5:     "0.05",
+		50:    "0.5",
+		99:    "0.99",
+		99.9:  "0.999",
+		99.99: "0.9999",
+		100:   "1",
+	}
+	for percent, expected := range tests {
+		if actual := quantile(percent); actual != expected {
+			t.Errorf("expected the quantile of %v to be %s, got %s", percent, expected, actual)
+		}
+	}
+}
+
+func TestQueryCompositeAfterKeyPrecision(t *testing.T) {
+	// above 2^53, the closest float is 9007199254740992
+	const key = "9007199254740993"
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		if len(bodies) > 1 {
+			fmt.Fprint(w, `{"aggregations":{"documents":{"buckets":[]}}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"aggregations":{"documents":{
+			"after_key":{"documents":%s},
+			"buckets":[{"key":{"documents":%s},"doc_count":3}]
+		}}}`, key, key)
+	}))
+	defer server.Close()
+	backend, err := NewBackend(BackendElasticsearch, server.URL, Credentials{}, TLS{}, Timeouts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series, err := NewQuery(backend, "user.id", 5*time.Minute).
+		WithPagination(true).
+		Query(context.Background(), "logs", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertSeries(t, []Series{{Labels: map[string]string{}, Key: key, Values: []Value{{Value: 3}}}}, series)
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 pages, got %d", len(bodies))
+	}
+	if !strings.Contains(bodies[1], `"after":{"documents":`+key+`}`) {
+		t.Errorf("expected the second page to follow %s, got %s", key, bodies[1])
+	}
+}
@@ -0,0 +1,161 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+)
+
+// Job is a function run periodically, either every Interval or on the cron
+// expression in Schedule when it is set. The context of its runs is cancelled
+// when the job is removed or the scheduler stops.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Schedule string
+	Run      func(ctx context.Context)
+}
+
+// Scheduler runs the jobs of every registered key, replacing them when the
+// version they were registered with changes
+type Scheduler struct {
+	cron    *gocron.Scheduler
+	entries map[string]*entry
+	lock    *sync.Mutex
+}
+
+// entry tracks the jobs registered under a key, runs hold a read lock so that
+// removing the key can cancel them and wait for them to finish
+type entry struct {
+	version string
+	removed bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	lock    *sync.RWMutex
+}
+
+func NewScheduler() *Scheduler {
+	cron := gocron.NewScheduler(time.UTC)
+	cron.SingletonModeAll()
+
+	scheduler := &Scheduler{
+		cron:    cron,
+		entries: map[string]*entry{},
+		lock:    &sync.Mutex{},
+	}
+	return scheduler
+}
+
+// Start runs the scheduled jobs until the context is cancelled, cancelling
+// the runs in progress then
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.cron.StartAsync()
+	<-ctx.Done()
+
+	s.lock.Lock()
+	for _, e := range s.entries {
+		e.cancel()
+	}
+	s.lock.Unlock()
+	s.cron.Stop()
+	return nil
+}
+
+// Validate fails if the job has neither a valid cron expression nor a
+// positive interval, gocron would run it continuously with a zero interval
+func (job Job) Validate() error {
+	if job.Schedule != "" {
+		return ValidateSchedule(job.Schedule)
+	}
+	if job.Interval <= 0 {
+		return errors.Errorf("interval %s of job %s is not positive", job.Interval, job.Name)
+	}
+	return nil
+}
+
+// ValidateSchedule fails if schedule is not a cron expression accepted by
+// the scheduler
+func ValidateSchedule(schedule string) error {
+	// gocron prefixes expressions with the time zone of the scheduler
+	if _, err := cron.ParseStandard("CRON_TZ=UTC " + schedule); err != nil {
+		return errors.Wrapf(err, "invalid cron expression %s", schedule)
+	}
+	return nil
+}
+
+// Schedule registers jobs under key, removing the jobs previously registered
+// under the same key. It is a no-op if the key is already scheduled with the
+// same version. Invalid jobs leave the previous jobs scheduled.
+func (s *Scheduler) Schedule(key, version string, jobs []Job) error {
+	for _, job := range jobs {
+		if err := job.Validate(); err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if current, found := s.entries[key]; found && current.version == version {
+		return nil
+	}
+
+	s.remove(key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &entry{version: version, ctx: ctx, cancel: cancel, lock: &sync.RWMutex{}}
+	for _, job := range jobs {
+		var cron *gocron.Scheduler
+		if job.Schedule != "" {
+			cron = s.cron.Cron(job.Schedule).StartImmediately()
+		} else {
+			cron = s.cron.Every(job.Interval)
+		}
+		if _, err := cron.Tag(key).Do(e.run, job.Run); err != nil {
+			_ = s.cron.RemoveByTag(key)
+			cancel()
+			return errors.Wrapf(err, "failed to schedule job %s", job.Name)
+		}
+	}
+
+	s.entries[key] = e
+	return nil
+}
+
+// Remove stops and removes every job registered under key, cancelling the
+// runs in progress and waiting for them to finish
+func (s *Scheduler) Remove(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.remove(key)
+}
+
+func (s *Scheduler) remove(key string) {
+	// RemoveByTag only fails when no job carries the tag
+	_ = s.cron.RemoveByTag(key)
+
+	e, found := s.entries[key]
+	if !found {
+		return
+	}
+	e.cancel()
+	e.lock.Lock()
+	e.removed = true
+	e.lock.Unlock()
+	delete(s.entries, key)
+}
+
+func (e *entry) run(run func(ctx context.Context)) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.removed {
+		return
+	}
+	run(e.ctx)
+}
@@ -0,0 +1,114 @@
+package standalone
+
+import (
+	"io/ioutil"
+	"os"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// Config lists the ElasticLogs exported in standalone mode
+type Config struct {
+	ElasticLogs []ElasticLogs `json:"elasticLogs,omitempty"`
+}
+
+// ElasticLogs is the spec of an ElasticLogs whose credentials are read from
+// environment variables or files instead of secrets
+type ElasticLogs struct {
+	Name        string                    `json:"name"`
+	Credentials Credentials               `json:"credentials,omitempty"`
+	Spec        elasticv1.ElasticLogsSpec `json:"spec"`
+}
+
+// Credentials replace the secrets and config maps referenced by the spec
+type Credentials struct {
+	Password   *Value `json:"password,omitempty"`
+	APIKey     *Value `json:"apiKey,omitempty"`
+	Token      *Value `json:"token,omitempty"`
+	ClientCert *Value `json:"clientCert,omitempty"`
+	ClientKey  *Value `json:"clientKey,omitempty"`
+	CA         *Value `json:"ca,omitempty"`
+}
+
+// Value is read from the environment variable Env or from File
+type Value struct {
+	Env  string `json:"env,omitempty"`
+	File string `json:"file,omitempty"`
+}
+
+// ParseConfig decodes a YAML config and checks that every ElasticLogs has a
+// unique name
+func ParseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, errors.Wrap(err, "failed to decode config")
+	}
+	names := map[string]bool{}
+	for _, elasticLogs := range config.ElasticLogs {
+		if elasticLogs.Name == "" {
+			return nil, errors.New("elasticLogs without name")
+		}
+		if names[elasticLogs.Name] {
+			return nil, errors.Errorf("duplicate elasticLogs %s", elasticLogs.Name)
+		}
+		names[elasticLogs.Name] = true
+	}
+	return config, nil
+}
+
+// Read returns the value of the environment variable or the content of the
+// file
+func (v *Value) Read() ([]byte, error) {
+	if v.Env != "" {
+		value, found := os.LookupEnv(v.Env)
+		if !found {
+			return nil, errors.Errorf("environment variable %s is not set", v.Env)
+		}
+		return []byte(value), nil
+	}
+	if v.File != "" {
+		value, err := ioutil.ReadFile(v.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", v.File)
+		}
+		return value, nil
+	}
+	return nil, errors.New("value without env or file")
+}
+
+// Resolve reads the credentials and TLS options of the spec
+func (c Credentials) Resolve(spec elasticv1.ElasticLogsSpec) (query.Credentials, query.TLS, error) {
+	credentials := query.Credentials{Username: spec.Username}
+	tlsOptions := query.TLS{}
+	if spec.TLS != nil {
+		tlsOptions.ServerName = spec.TLS.ServerName
+		tlsOptions.InsecureSkipVerify = spec.TLS.InsecureSkipVerify
+	}
+
+	values := []struct {
+		name  string
+		value *Value
+		set   func([]byte)
+	}{
+		{"password", c.Password, func(value []byte) { credentials.Password = string(value) }},
+		{"apiKey", c.APIKey, func(value []byte) { credentials.APIKey = string(value) }},
+		{"token", c.Token, func(value []byte) { credentials.Token = string(value) }},
+		{"clientCert", c.ClientCert, func(value []byte) { credentials.ClientCert = value }},
+		{"clientKey", c.ClientKey, func(value []byte) { credentials.ClientKey = value }},
+		{"ca", c.CA, func(value []byte) { tlsOptions.CA = value }},
+	}
+	for _, v := range values {
+		if v.value == nil {
+			continue
+		}
+		value, err := v.value.Read()
+		if err != nil {
+			return credentials, tlsOptions, errors.Wrapf(err, "failed to read %s", v.name)
+		}
+		v.set(value)
+	}
+	return credentials, tlsOptions, nil
+}
@@ -0,0 +1,114 @@
+package standalone
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/controllers"
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Runner exports the ElasticLogs of a config file, reloading them whenever
+// the file changes
+type Runner struct {
+	Path     string
+	Exporter *controllers.ElasticLogsReconciler
+	Log      logr.Logger
+	// hash of the last loaded config and names of its ElasticLogs
+	hash  string
+	names map[string]bool
+}
+
+// Start loads the config and watches its directory until ctx is done. The
+// directory is watched rather than the file as editors and config map mounts
+// replace the file instead of writing it.
+func (r *Runner) Start(ctx context.Context) error {
+	if err := r.reload(); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "failed to create watcher")
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(r.Path)); err != nil {
+		return errors.Wrapf(err, "failed to watch %s", r.Path)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if err := r.reload(); err != nil {
+				r.Log.Error(err, "failed to reload config", "path", r.Path)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			r.Log.Error(err, "failed to watch config", "path", r.Path)
+		}
+	}
+}
+
+// reload exports the ElasticLogs of the config and removes the ones no longer
+// in it, ElasticLogs whose credentials cannot be read keep their previous
+// queries
+func (r *Runner) reload() error {
+	data, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", r.Path)
+	}
+	hasher := md5.New()
+	hasher.Write(data)
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if hash == r.hash {
+		return nil
+	}
+
+	config, err := ParseConfig(data)
+	if err != nil {
+		return err
+	}
+	r.Log.Info("Loading config", "path", r.Path)
+
+	names := map[string]bool{}
+	for _, elasticLogs := range config.ElasticLogs {
+		names[elasticLogs.Name] = true
+		credentials, tlsOptions, err := elasticLogs.Credentials.Resolve(elasticLogs.Spec)
+		if err != nil {
+			r.Log.Error(err, "failed to resolve credentials", "ElasticLogs", elasticLogs.Name)
+			continue
+		}
+		metric := elasticv1.ElasticLogs{
+			ObjectMeta: metav1.ObjectMeta{Name: elasticLogs.Name},
+			Spec:       elasticLogs.Spec,
+		}
+		if err := r.Exporter.Export(metric, credentials, tlsOptions); err != nil {
+			r.Log.Error(err, "failed to export", "ElasticLogs", elasticLogs.Name)
+		}
+	}
+
+	for name := range r.names {
+		if !names[name] {
+			r.Log.Info("Removing queries and series", "ElasticLogs", name)
+			r.Exporter.Remove(types.NamespacedName{Name: name})
+		}
+	}
+	r.hash = hash
+	r.names = names
+	return nil
+}
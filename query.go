@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	elasticv1 "github.com/flanksource/logs-exporter/pkg/api/v1"
+	"github.com/flanksource/logs-exporter/pkg/controllers"
+	"github.com/flanksource/logs-exporter/pkg/metrics"
+	"github.com/flanksource/logs-exporter/pkg/query"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/spf13/cobra"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/yaml"
+)
+
+func newQueryCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "query <elastic-logs.yaml>",
+		Short: "Query the tuples of an ElasticLogs once and print the resulting series",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runQuery,
+		// errors of the queries are not usage errors
+		SilenceUsage: true,
+	}
+	command.Flags().String("url", "", "Elasticsearch URL, defaults to the url of the spec")
+	command.Flags().String("username", "", "Username, defaults to the username of the spec")
+	command.Flags().String("password", "", "Password, defaults to $ELASTIC_PASSWORD")
+	command.Flags().String("api-key", "", "Base64 encoded id:api_key pair used instead of the username and password")
+	command.Flags().String("token", "", "Bearer token used instead of the username and password")
+	command.Flags().String("ca-file", "", "PEM encoded bundle of certificate authorities trusted instead of the system ones")
+	command.Flags().Bool("insecure-skip-verify", false, "Skip the verification of the elasticsearch certificate")
+	command.Flags().StringP("output", "o", "prometheus", "Output format, prometheus or table")
+	return command
+}
+
+func runQuery(cmd *cobra.Command, args []string) error {
+	queryInterval, _ := cmd.Flags().GetDuration("query-interval")
+	output, _ := cmd.Flags().GetString("output")
+	logQueries, _ := cmd.Flags().GetBool("log-queries")
+	if output != "prometheus" && output != "table" {
+		return errors.Errorf("unknown output %s", output)
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", args[0])
+	}
+	metric := elasticv1.ElasticLogs{}
+	if err := yaml.Unmarshal(data, &metric); err != nil {
+		return errors.Wrapf(err, "failed to decode %s", args[0])
+	}
+
+	url, credentials, tlsOptions, err := queryOptions(cmd, metric.Spec)
+	if err != nil {
+		return err
+	}
+	backend, err := query.NewBackend(metric.Spec.Type, url, credentials, tlsOptions, query.Timeouts{})
+	if err != nil {
+		return err
+	}
+
+	exporter := &controllers.ElasticLogsReconciler{
+		Log:         ctrl.Log.WithName("query"),
+		Interval:    queryInterval,
+		MetricStore: metrics.NewMetricStore(),
+		LogQueries:  logQueries,
+		Limiter:     newLimiter(cmd),
+	}
+	queryErr := exporter.Query(context.Background(), backend, metric)
+
+	families, err := ctrlmetrics.Registry.Gather()
+	if err != nil {
+		return errors.Wrap(err, "failed to gather metrics")
+	}
+	names := map[string]bool{}
+	for _, tuple := range metric.Spec.Tuples {
+		names[tuple.MetricName] = true
+	}
+	tupleFamilies := []*dto.MetricFamily{}
+	for _, family := range families {
+		if names[family.GetName()] {
+			tupleFamilies = append(tupleFamilies, family)
+		}
+	}
+
+	if output == "table" {
+		err = printTable(tupleFamilies)
+	} else {
+		err = printPrometheus(tupleFamilies)
+	}
+	if err != nil {
+		return err
+	}
+	return queryErr
+}
+
+// queryOptions returns the URL, credentials and TLS options of the spec,
+// overridden by the flags
+func queryOptions(cmd *cobra.Command, spec elasticv1.ElasticLogsSpec) (string, query.Credentials, query.TLS, error) {
+	url, _ := cmd.Flags().GetString("url")
+	username, _ := cmd.Flags().GetString("username")
+	password, _ := cmd.Flags().GetString("password")
+	// read at run time so that the help does not print the password
+	if password == "" {
+		password = os.Getenv("ELASTIC_PASSWORD")
+	}
+	apiKey, _ := cmd.Flags().GetString("api-key")
+	token, _ := cmd.Flags().GetString("token")
+	caFile, _ := cmd.Flags().GetString("ca-file")
+	insecureSkipVerify, _ := cmd.Flags().GetBool("insecure-skip-verify")
+
+	if url == "" {
+		url = spec.URL
+	}
+	if username == "" {
+		username = spec.Username
+	}
+
+	credentials := query.Credentials{}
+	switch {
+	case apiKey != "":
+		credentials.APIKey = apiKey
+	case token != "":
+		credentials.Token = token
+	default:
+		credentials.Username = username
+		credentials.Password = password
+	}
+
+	tlsOptions := query.TLS{InsecureSkipVerify: insecureSkipVerify}
+	if spec.TLS != nil {
+		tlsOptions.ServerName = spec.TLS.ServerName
+		tlsOptions.InsecureSkipVerify = tlsOptions.InsecureSkipVerify || spec.TLS.InsecureSkipVerify
+	}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return "", credentials, tlsOptions, errors.Wrapf(err, "failed to read %s", caFile)
+		}
+		tlsOptions.CA = ca
+	}
+	return url, credentials, tlsOptions, nil
+}
+
+func printPrometheus(families []*dto.MetricFamily) error {
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(os.Stdout, family); err != nil {
+			return errors.Wrap(err, "failed to print metrics")
+		}
+	}
+	return nil
+}
+
+func printTable(families []*dto.MetricFamily) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "METRIC\tLABELS\tVALUE")
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := []string{}
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%s", label.GetName(), label.GetValue()))
+			}
+			sort.Strings(labels)
+			fmt.Fprintf(writer, "%s\t%s\t%v\n", family.GetName(), strings.Join(labels, ","), metric.GetGauge().GetValue())
+		}
+	}
+	return writer.Flush()
+}